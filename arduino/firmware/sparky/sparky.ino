@@ -30,6 +30,10 @@
 #define TURN_RIGHT   0x01
 #define TURN_RESP    0x02
 
+// move turn modes
+#define TURN_PIVOT   0x00
+#define TURN_SPIN    0x01
+
 // move sub commands
 #define MOVE_RUN         0x00
 #define MOVE_STEP        0x01
@@ -37,6 +41,8 @@
 #define MOVE_TURN        0x03
 #define MOVE_TURN_RESP   0x04
 #define MOVE_STEP_RESP   0x05
+#define MOVE_DRIVE       0x06
+#define MOVE_SPEED       0x07
 
 #define MOVE_DIR_FWD 0x00
 #define MOVE_DIR_REV 0x01
@@ -53,6 +59,22 @@
 
 #define LINE_REQ       0x00
 #define LINE_RESP      0x01
+#define LINE_STREAM    0x02
+#define LINE_EVENT     0x03
+#define LINE_ANALOG_REQ   0x04
+#define LINE_ANALOG_RESP  0x05
+#define LINE_ANALOG_EVENT 0x06
+
+// line stream modes
+#define LINE_STREAM_OFF     0x00
+#define LINE_STREAM_DIGITAL 0x01
+#define LINE_STREAM_ANALOG  0x02
+
+// how much an analog reading has to change to be streamed
+#define LINE_ANALOG_DELTA 8
+
+// how often the line sensors are checked while streaming, in ms
+#define LINE_STREAM_INTERVAL 10
 
 #define BLUSERIAL_TX 0
 #define BLUSERIAL_RX 1
@@ -163,19 +185,37 @@ void roverRun(int dir, int left, int right) {
       digitalWrite(WHEEL_LEFT_DIR, HIGH);
       digitalWrite(WHEEL_RIGHT_DIR, HIGH);
 
-      analogWrite(WHEEL_RIGHT_SPEED, 255 - PWM_RIGHT);
-      analogWrite(WHEEL_LEFT_SPEED, 255 - PWM_LEFT);
+      analogWrite(WHEEL_RIGHT_SPEED, 255 - right);
+      analogWrite(WHEEL_LEFT_SPEED, 255 - left);
       break;
   case MOVE_DIR_REV:
       digitalWrite(WHEEL_LEFT_DIR, LOW);
       digitalWrite(WHEEL_RIGHT_DIR, LOW);
       
-      analogWrite(WHEEL_RIGHT_SPEED, PWM_RIGHT);
-      analogWrite(WHEEL_LEFT_SPEED, PWM_LEFT);
+      analogWrite(WHEEL_RIGHT_SPEED, right);
+      analogWrite(WHEEL_LEFT_SPEED, left);
       break;
   }
 }
 
+void wheelDrive(int dirPin, int speedPin, int dir, int speed) {
+  switch (dir) {
+  case MOVE_DIR_FWD:
+      digitalWrite(dirPin, HIGH);
+      analogWrite(speedPin, 255 - speed);
+      break;
+  case MOVE_DIR_REV:
+      digitalWrite(dirPin, LOW);
+      analogWrite(speedPin, speed);
+      break;
+  }
+}
+
+void roverDrive(int leftDir, int left, int rightDir, int right) {
+  wheelDrive(WHEEL_LEFT_DIR, WHEEL_LEFT_SPEED, leftDir, left);
+  wheelDrive(WHEEL_RIGHT_DIR, WHEEL_RIGHT_SPEED, rightDir, right);
+}
+
 void roverStop() {
   digitalWrite(WHEEL_RIGHT_SPEED, LOW);
   digitalWrite(WHEEL_LEFT_SPEED, LOW);   
@@ -183,16 +223,56 @@ void roverStop() {
   digitalWrite(WHEEL_RIGHT_DIR, LOW);  
 }
 
-void roverTurnDone() {
- roverStop(); 
+// the timer of the step or turn in progress, -1 when there is none, and
+// the response it owes
+int8_t motionTimer = -1;
+byte motionResp;
+
+void writeMotionResp(byte resp) {
  Firmata.write(START_SYSEX);
  Firmata.write(ROVER_MOVE); 
- Firmata.write(MOVE_TURN_RESP);
+ Firmata.write(resp);
  Firmata.write(END_SYSEX);   
 }
 
-void roverTurn(byte side, byte dir, byte angle, int steps) {
-  int duration = angle * steps;
+void roverMotionDone() {
+ motionTimer = -1;
+ roverStop(); 
+ writeMotionResp(motionResp);
+}
+
+// cancelMotion ends the step or turn in progress early, as a new motion
+// command takes over the wheels. It is answered all the same, so that every
+// step and turn gets exactly one response.
+void cancelMotion() {
+ if (motionTimer < 0) {
+   return;
+ }
+ softwareTimer.stop(motionTimer);
+ motionTimer = -1;
+ writeMotionResp(motionResp);
+}
+
+void startMotionTimer(unsigned long duration, byte resp) {
+ motionResp = resp;
+ motionTimer = softwareTimer.after(duration, roverMotionDone);
+}
+
+void roverTurn(byte side, byte dir, byte mode, byte angle, int steps) {
+  unsigned long duration = (unsigned long)angle * steps;
+
+  if (mode == TURN_SPIN) {
+    switch(side) {
+      case TURN_LEFT:
+        roverDrive(MOVE_DIR_REV, PWM_LEFT, MOVE_DIR_FWD, PWM_RIGHT);
+        break;
+      case TURN_RIGHT:
+        roverDrive(MOVE_DIR_FWD, PWM_LEFT, MOVE_DIR_REV, PWM_RIGHT);
+        break;
+    }
+    startMotionTimer(duration, MOVE_TURN_RESP);
+    return;
+  }
 
   switch (dir) {
     case MOVE_DIR_FWD:
@@ -233,19 +313,11 @@ void roverTurn(byte side, byte dir, byte angle, int steps) {
         break;
   }
 
- softwareTimer.after(duration, roverTurnDone);
-}
-
-void stepDone() {
- roverStop(); 
- Firmata.write(START_SYSEX);
- Firmata.write(ROVER_MOVE); 
- Firmata.write(MOVE_STEP_RESP);
- Firmata.write(END_SYSEX);     
+ startMotionTimer(duration, MOVE_TURN_RESP);
 }
 
 void roverStep(byte dir, byte which, int steps) {
- int duration = 60*steps;
+ unsigned long duration = 60UL * steps;
  switch (which) {
    case MOVE_STEP_BOTH:
      roverRun(dir, 0, 0);
@@ -275,7 +347,7 @@ void roverStep(byte dir, byte which, int steps) {
      }          
      break;
  } 
- softwareTimer.after(duration, stepDone);
+ startMotionTimer(duration, MOVE_STEP_RESP);
 }
 
 void roverLight(byte red, byte green, byte blue) {
@@ -328,6 +400,76 @@ void roverReportLineReadings() {
   Firmata.write(END_SYSEX);
 }
 
+void writeLineAnalog(byte oper, int left, int right) {
+  Firmata.write(START_SYSEX);
+  Firmata.write(ROVER_LINE);
+  Firmata.write(oper);
+  Firmata.write(left & 0x7F);
+  Firmata.write((left >> 7) & 0x7F);
+  Firmata.write(right & 0x7F);
+  Firmata.write((right >> 7) & 0x7F);
+  Firmata.write(END_SYSEX);
+}
+
+void roverReportLineAnalog() {
+  writeLineAnalog(LINE_ANALOG_RESP, analogRead(LINE_LEFT), analogRead(LINE_RIGHT));
+}
+
+byte lineStreaming = LINE_STREAM_OFF;
+byte lastLineLeft, lastLineRight;
+int lastAnalogLeft, lastAnalogRight;
+unsigned long lastLineCheck;
+
+void roverStreamLine(byte mode) {
+  lineStreaming = mode;
+  // report the current readings straight away
+  lastLineLeft = 0xFF;
+  lastLineRight = 0xFF;
+  lastAnalogLeft = -1024;
+  lastAnalogRight = -1024;
+}
+
+void roverCheckLineAnalog() {
+  int left, right;
+
+  left = analogRead(LINE_LEFT);
+  right = analogRead(LINE_RIGHT);
+  if (abs(left - lastAnalogLeft) < LINE_ANALOG_DELTA && abs(right - lastAnalogRight) < LINE_ANALOG_DELTA) {
+    return;
+  }
+  lastAnalogLeft = left;
+  lastAnalogRight = right;
+  writeLineAnalog(LINE_ANALOG_EVENT, left, right);
+}
+
+void roverCheckLine() {
+  byte lineRight, lineLeft;
+
+  if (lineStreaming == LINE_STREAM_OFF || millis() - lastLineCheck < LINE_STREAM_INTERVAL) {
+    return;
+  }
+  lastLineCheck = millis();
+  if (lineStreaming == LINE_STREAM_ANALOG) {
+    roverCheckLineAnalog();
+    return;
+  }
+
+  lineLeft = digitalRead(LINE_LEFT);
+  lineRight = digitalRead(LINE_RIGHT);
+  if (lineLeft == lastLineLeft && lineRight == lastLineRight) {
+    return;
+  }
+  lastLineLeft = lineLeft;
+  lastLineRight = lineRight;
+
+  Firmata.write(START_SYSEX);
+  Firmata.write(ROVER_LINE);
+  Firmata.write(LINE_EVENT);
+  Firmata.write(lineLeft);
+  Firmata.write(lineRight);
+  Firmata.write(END_SYSEX);
+}
+
 void sysexCallback(byte command, byte argc, byte *argv)
 {
   byte mode;
@@ -414,6 +556,9 @@ void sysexCallback(byte command, byte argc, byte *argv)
     case ROVER_MOVE:
        int dir, side, which;
        int left, right, steps;
+       if (argv[0] != MOVE_SPEED) {
+           cancelMotion();
+       }
        switch (argv[0]) {
        case MOVE_RUN:
            dir = argv[1];
@@ -426,6 +571,15 @@ void sysexCallback(byte command, byte argc, byte *argv)
            }
            roverRun(dir, left, right);
            break;
+       case MOVE_DRIVE:
+           left = argv[2] | (argv[3] << 7);
+           right = argv[5] | (argv[6] << 7);
+           roverDrive(argv[1], left, argv[4], right);
+           break;
+       case MOVE_SPEED:
+           PWM_LEFT = argv[1] | (argv[2] << 7);
+           PWM_RIGHT = argv[3] | (argv[4] << 7);
+           break;
        case MOVE_STOP:
            roverStop();
            break;
@@ -434,7 +588,7 @@ void sysexCallback(byte command, byte argc, byte *argv)
            dir = argv[2];
            angle = argv[3];
            steps = argv[4] | (argv[5] << 7);
-           roverTurn(side, dir, angle, steps);
+           roverTurn(side, dir, argc > 6 ? argv[6] : TURN_PIVOT, angle, steps);
            break;
        case MOVE_STEP:
           which = argv[1];
@@ -475,7 +629,17 @@ void sysexCallback(byte command, byte argc, byte *argv)
    case ROVER_HEARTBEAT:
        break;
    case ROVER_LINE:
-      roverReportLineReadings();
+      switch (argv[0]) {
+      case LINE_STREAM:
+          roverStreamLine(argv[1]);
+          break;
+      case LINE_ANALOG_REQ:
+          roverReportLineAnalog();
+          break;
+      default:
+          roverReportLineReadings();
+          break;
+      }
       break;
   }
 }
@@ -487,10 +651,12 @@ void sysexCallback(byte command, byte argc, byte *argv)
 void systemResetCallback()
 {
 
+  cancelMotion();
   roverStop();
   centerHead();
   roverLight(0,0,0);
   buzzerOff();
+  lineStreaming = LINE_STREAM_OFF;
 
   PWM_LEFT = 200;
   PWM_RIGHT = 200;  
@@ -553,5 +719,6 @@ void loop()
 
   softwareTimer.update();
   SoftwareServo::refresh();
+  roverCheckLine();
 }
 
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/sparkybots/gobot"
@@ -76,12 +77,17 @@ const (
 	TurnRight byte = 0x01
 	TurnResp  byte = 0x02
 
+	TurnModePivot byte = 0x00
+	TurnModeSpin  byte = 0x01
+
 	MoveRun      byte = 0x00
 	MoveStep     byte = 0x01
 	MoveStop     byte = 0x02
 	MoveTurn     byte = 0x03
 	MoveTurnResp byte = 0x04
 	MoveStepResp byte = 0x05
+	MoveDrive    byte = 0x06
+	MoveSpeed    byte = 0x07
 
 	MoveDirFwd byte = 0x00
 	MoveDirRev byte = 0x01
@@ -98,6 +104,18 @@ const (
 
 	LineReq  byte = 0x00
 	LineResp byte = 0x01
+	// LineStream sets the line stream mode. While streaming, the firmware
+	// sends a LineEvent whenever a line sensor changes, or a LineAnalogEvent
+	// whenever an analog reading changes noticeably.
+	LineStream      byte = 0x02
+	LineEvent       byte = 0x03
+	LineAnalogReq   byte = 0x04
+	LineAnalogResp  byte = 0x05
+	LineAnalogEvent byte = 0x06
+
+	LineStreamOff     byte = 0x00
+	LineStreamDigital byte = 0x01
+	LineStreamAnalog  byte = 0x02
 )
 
 // Errors
@@ -114,6 +132,7 @@ type Board struct {
 	connection       io.ReadWriteCloser
 	analogPins       []int
 	initTimeInterval time.Duration
+	writeMutex       sync.Mutex
 	gobot.Eventer
 }
 
@@ -158,6 +177,9 @@ func New() *Board {
 		"RoverTurnDone",
 		"RoverStepDone",
 		"RoverLineResponse",
+		"RoverLineEvent",
+		"RoverLineAnalogResponse",
+		"RoverLineAnalogEvent",
 		"Error",
 	} {
 		c.AddEvent(s)
@@ -361,12 +383,26 @@ func (b *Board) RoverRun(dir byte, leftSpeed byte, rightSpeed byte) error {
 	}
 }
 
+// RoverSetSpeed sets the default PWM duty of each wheel, used by steps,
+// turns and runs without explicit speeds. A board reset restores the
+// firmware defaults.
+func (b *Board) RoverSetSpeed(leftSpeed int, rightSpeed int) error {
+	return b.writeSysex([]byte{RoverMove, MoveSpeed, byte(leftSpeed & 0x7F), byte((leftSpeed >> 7) & 0x7F), byte(rightSpeed & 0x7F), byte((rightSpeed >> 7) & 0x7F)})
+}
+
+// RoverDrive sets the direction and PWM duty of each wheel separately.
+func (b *Board) RoverDrive(leftDir byte, leftSpeed int, rightDir byte, rightSpeed int) error {
+	return b.writeSysex([]byte{RoverMove, MoveDrive, leftDir, byte(leftSpeed & 0x7F), byte((leftSpeed >> 7) & 0x7F), rightDir, byte(rightSpeed & 0x7F), byte((rightSpeed >> 7) & 0x7F)})
+}
+
 func (b *Board) RoverStop() error {
 	return b.writeSysex([]byte{RoverMove, MoveStop})
 }
 
-func (b *Board) RoverTurn(side byte, dir byte, angle byte, steps int) error {
-	return b.writeSysex([]byte{RoverMove, MoveTurn, side, dir, angle, byte(steps & 0x7F), byte((steps >> 7) & 0x7F)})
+// RoverTurn turns towards side for angle times steps milliseconds. angle
+// must be below 128 to fit in a single data byte.
+func (b *Board) RoverTurn(side byte, dir byte, mode byte, angle byte, steps int) error {
+	return b.writeSysex([]byte{RoverMove, MoveTurn, side, dir, angle & 0x7F, byte(steps & 0x7F), byte((steps >> 7) & 0x7F), mode})
 }
 
 func (b *Board) RoverStep(dir byte, steps int) error {
@@ -415,6 +451,15 @@ func (b *Board) RoverReadLineSensors() error {
 	return b.writeSysex([]byte{RoverLine, LineReq})
 }
 
+func (b *Board) RoverReadLineAnalog() error {
+	return b.writeSysex([]byte{RoverLine, LineAnalogReq})
+}
+
+// RoverLineStream sets the line stream mode, one of the LineStream modes.
+func (b *Board) RoverLineStream(mode byte) error {
+	return b.writeSysex([]byte{RoverLine, LineStream, mode})
+}
+
 func (b *Board) togglePinReporting(pin int, state int, mode byte) error {
 	if state != 0 {
 		state = 1
@@ -435,6 +480,9 @@ func (b *Board) writeSysex(data []byte) (err error) {
 }
 
 func (b *Board) write(data []byte) (err error) {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+
 	n, err := b.connection.Write(data[:])
 	if n < len(data) {
 		err = fmt.Errorf("Could not write requested bytes err: %s", err)
@@ -645,11 +693,25 @@ func (b *Board) process() (err error) {
 		case RoverLine:
 			fmt.Println("Recived line response")
 			oper := currentBuffer[2]
-			if oper == LineResp {
+			switch oper {
+			case LineResp:
 				left := currentBuffer[3]
 				right := currentBuffer[4]
 				value := (right << 1) | left
 				gobot.Publish(b.Event("RoverLineResponse"), value)
+			case LineEvent:
+				left := currentBuffer[3]
+				right := currentBuffer[4]
+				value := (right << 1) | left
+				gobot.Publish(b.Event("RoverLineEvent"), value)
+			case LineAnalogResp, LineAnalogEvent:
+				left := int(currentBuffer[3]) | int(currentBuffer[4])<<7
+				right := int(currentBuffer[5]) | int(currentBuffer[6])<<7
+				if oper == LineAnalogResp {
+					gobot.Publish(b.Event("RoverLineAnalogResponse"), []int{left, right})
+				} else {
+					gobot.Publish(b.Event("RoverLineAnalogEvent"), []int{left, right})
+				}
 			}
 		}
 	}
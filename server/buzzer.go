@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"github.com/sparkybots/gobot"
 	"github.com/sparkybots/sparky/server/board"
 	"strconv"
+	"time"
 )
 
 const (
@@ -12,7 +14,7 @@ const (
 
 type Buzzer struct {
 	board     *board.Board
-	reqQueue  chan BuzzerReq
+	reqQueue  *RequestQueue
 	respQueue chan Work
 }
 
@@ -34,11 +36,11 @@ func (r BuzzerReq) GetRespValue() string {
 	return strconv.Itoa(r.Result)
 }
 
-func CreateBuzzer(b *board.Board, respQ chan Work) Buzzer {
+func CreateBuzzer(b *board.Board, respQ chan Work) *Buzzer {
 
-	buzzer := Buzzer{
+	buzzer := &Buzzer{
 		board:     b,
-		reqQueue:  make(chan BuzzerReq, 100),
+		reqQueue:  NewRequestQueue(),
 		respQueue: respQ,
 	}
 
@@ -47,11 +49,15 @@ func CreateBuzzer(b *board.Board, respQ chan Work) Buzzer {
 }
 
 func (bz *Buzzer) PlayTone(id string, freq int, delay int) error {
+	req := BuzzerReq{ID: id, ReqType: BuzzerPlayReq, Result: 0}
 	if delay > 0 {
-		req := BuzzerReq{ID: id, ReqType: BuzzerPlayReq, Result: 0}
-		bz.reqQueue <- req
+		bz.reqQueue.Push(req, time.Duration(delay)*time.Millisecond)
 	}
-	return bz.board.RoverPlayTone(byte(freq), delay)
+	err := bz.board.RoverPlayTone(byte(freq), delay)
+	if err != nil && delay > 0 {
+		bz.reqQueue.Remove(req)
+	}
+	return err
 }
 
 func (bz *Buzzer) BuzzerOff() error {
@@ -63,6 +69,18 @@ func (bz *Buzzer) Beep() error {
 }
 
 func (bz *Buzzer) processBuzzerDone(data interface{}) {
-	req := <-bz.reqQueue
+	req, ok := bz.reqQueue.Pop()
+	if !ok {
+		fmt.Println("Buzzer: Discarding done response with no pending request")
+		return
+	}
 	bz.respQueue <- req
 }
+
+func (bz *Buzzer) FlushRequests() {
+	bz.reqQueue.Flush()
+}
+
+func (bz *Buzzer) ExpireRequests(now time.Time) []Work {
+	return bz.reqQueue.Expire(now)
+}
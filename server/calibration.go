@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// DefaultMillisPerDegree is the pivot turn rate of an uncalibrated rover.
+const DefaultMillisPerDegree = 6
+
+// Calibration describes how a particular rover moves, so that commands given
+// in centimetres, seconds and degrees can be converted into firmware steps
+// and turn timings.
+type Calibration struct {
+	// CmPerStep is the distance covered in one firmware step at the default
+	// wheel PWM
+	CmPerStep float64 `json:"cmPerStep"`
+
+	// turn rates in degrees per millisecond at the default wheel PWM
+	LeftDegreesPerMilli      float64 `json:"leftDegreesPerMilli"`
+	RightDegreesPerMilli     float64 `json:"rightDegreesPerMilli"`
+	LeftSpinDegreesPerMilli  float64 `json:"leftSpinDegreesPerMilli"`
+	RightSpinDegreesPerMilli float64 `json:"rightSpinDegreesPerMilli"`
+
+	// LeftTrim and RightTrim scale the speed of each wheel, 1 leaves it as is
+	LeftTrim  float64 `json:"leftTrim"`
+	RightTrim float64 `json:"rightTrim"`
+
+	// SonarCenter is the angle, positive to the right, at which the sonar
+	// head actually faces forward. SonarLeftLimit and SonarRightLimit are the
+	// furthest the head may turn either way.
+	SonarCenter     int `json:"sonarCenter"`
+	SonarLeftLimit  int `json:"sonarLeftLimit"`
+	SonarRightLimit int `json:"sonarRightLimit"`
+
+	// analog line sensor readings over a black line and a white surface.
+	// While they are the same, the line sensors are taken as uncalibrated and
+	// the board's own digital readings are used.
+	LineLeftBlack  float64 `json:"lineLeftBlack"`
+	LineLeftWhite  float64 `json:"lineLeftWhite"`
+	LineRightBlack float64 `json:"lineRightBlack"`
+	LineRightWhite float64 `json:"lineRightWhite"`
+	// LineHysteresis is the part of the range between black and white,
+	// around the middle, in which a line sensor keeps its previous reading
+	LineHysteresis float64 `json:"lineHysteresis"`
+	// CliffMargin is how far beyond black, in parts of the range between
+	// black and white, a reading has to be to show a drop rather than a line
+	CliffMargin float64 `json:"cliffMargin"`
+	// Acceleration is how fast the wheels speed up and slow down, in percent
+	// of full speed per second. 0 changes speed at once.
+	Acceleration float64 `json:"acceleration"`
+}
+
+func DefaultCalibration() *Calibration {
+	return &Calibration{
+		CmPerStep:                1.2,
+		LeftDegreesPerMilli:      1.0 / DefaultMillisPerDegree,
+		RightDegreesPerMilli:     1.0 / DefaultMillisPerDegree,
+		LeftSpinDegreesPerMilli:  2.0 / DefaultMillisPerDegree,
+		RightSpinDegreesPerMilli: 2.0 / DefaultMillisPerDegree,
+		LeftTrim:                 1,
+		RightTrim:                1,
+		SonarCenter:              0,
+		SonarLeftLimit:           90,
+		SonarRightLimit:          90,
+		LineHysteresis:           0.2,
+		CliffMargin:              0.5,
+		Acceleration:             200,
+	}
+}
+
+// Validate checks that the rates commands are converted with are positive,
+// since steps and turn timings are found by dividing by them.
+func (c *Calibration) Validate() error {
+	rates := []struct {
+		name  string
+		value float64
+	}{
+		{"cmPerStep", c.CmPerStep},
+		{"leftDegreesPerMilli", c.LeftDegreesPerMilli},
+		{"rightDegreesPerMilli", c.RightDegreesPerMilli},
+		{"leftSpinDegreesPerMilli", c.LeftSpinDegreesPerMilli},
+		{"rightSpinDegreesPerMilli", c.RightSpinDegreesPerMilli},
+	}
+	for _, rate := range rates {
+		if !(rate.value > 0) {
+			return fmt.Errorf("Invalid calibration %s %v, must be positive", rate.name, rate.value)
+		}
+	}
+	return nil
+}
+
+// Set changes the field with the given JSON name. The calibration is left
+// unchanged if the new value is not valid.
+func (c *Calibration) Set(field string, value float64) error {
+	updated := *c
+	if err := updated.set(field, value); err != nil {
+		return err
+	}
+	if err := updated.Validate(); err != nil {
+		return err
+	}
+	*c = updated
+	return nil
+}
+
+func (c *Calibration) set(field string, value float64) error {
+	switch field {
+	case "cmPerStep":
+		c.CmPerStep = value
+	case "leftDegreesPerMilli":
+		c.LeftDegreesPerMilli = value
+	case "rightDegreesPerMilli":
+		c.RightDegreesPerMilli = value
+	case "leftSpinDegreesPerMilli":
+		c.LeftSpinDegreesPerMilli = value
+	case "rightSpinDegreesPerMilli":
+		c.RightSpinDegreesPerMilli = value
+	case "leftTrim":
+		c.LeftTrim = value
+	case "rightTrim":
+		c.RightTrim = value
+	case "sonarCenter":
+		c.SonarCenter = int(value)
+	case "sonarLeftLimit":
+		c.SonarLeftLimit = int(value)
+	case "sonarRightLimit":
+		c.SonarRightLimit = int(value)
+	case "lineLeftBlack":
+		c.LineLeftBlack = value
+	case "lineLeftWhite":
+		c.LineLeftWhite = value
+	case "lineRightBlack":
+		c.LineRightBlack = value
+	case "lineRightWhite":
+		c.LineRightWhite = value
+	case "lineHysteresis":
+		c.LineHysteresis = value
+	case "cliffMargin":
+		c.CliffMargin = value
+	case "acceleration":
+		c.Acceleration = value
+	default:
+		return fmt.Errorf("Unknown calibration field %s", field)
+	}
+	return nil
+}
+
+// SetMillisPerDegree sets the pivot turn rate towards direction.
+func (c *Calibration) SetMillisPerDegree(direction string, millis int) {
+	if millis <= 0 {
+		return
+	}
+	if direction == "left" {
+		c.LeftDegreesPerMilli = 1 / float64(millis)
+	} else {
+		c.RightDegreesPerMilli = 1 / float64(millis)
+	}
+}
+
+// MillisPerDegree returns the pivot turn rate towards direction, rounded to
+// whole milliseconds as the firmware expects it.
+func (c *Calibration) MillisPerDegree(direction string) int {
+	return c.MillisForAngle(1, direction, TurnPivot)
+}
+
+// StepsForDistance returns the number of steps needed to drive cm.
+func (c *Calibration) StepsForDistance(cm float64) int {
+	return int(math.Floor(cm/c.CmPerStep + 0.5))
+}
+
+// StepsForDuration returns the number of steps closest to d.
+func (c *Calibration) StepsForDuration(d time.Duration) int {
+	return int(math.Floor(float64(d)/float64(StepTime) + 0.5))
+}
+
+// MillisForAngle returns how long the rover has to turn towards direction
+// in mode to cover degrees.
+func (c *Calibration) MillisForAngle(degrees float64, direction string, mode string) int {
+	return int(math.Floor(degrees/c.TurnRate(direction, mode) + 0.5))
+}
+
+// TurnRate returns the rate in degrees per millisecond of a turn towards
+// direction in mode.
+func (c *Calibration) TurnRate(direction string, mode string) float64 {
+	switch {
+	case direction == "left" && mode == TurnSpin:
+		return c.LeftSpinDegreesPerMilli
+	case mode == TurnSpin:
+		return c.RightSpinDegreesPerMilli
+	case direction == "left":
+		return c.LeftDegreesPerMilli
+	default:
+		return c.RightDegreesPerMilli
+	}
+}
+
+// Speed returns how fast the rover drives straight at the default wheel
+// PWM, in cm per second.
+func (c *Calibration) Speed() float64 {
+	return c.CmPerStep / StepTime.Seconds()
+}
+
+// WheelBase returns the distance between the wheels in cm. It follows from
+// the pivot turn rates, since in a pivot turn the outer wheel runs at the
+// straight line speed around the inner one.
+func (c *Calibration) WheelBase() float64 {
+	rate := (c.LeftDegreesPerMilli + c.RightDegreesPerMilli) / 2 * 1000 * math.Pi / 180
+	return c.Speed() / rate
+}
+
+// LineCalibrated reports whether both line sensors have been calibrated on
+// black and white.
+func (c *Calibration) LineCalibrated() bool {
+	return c.LineLeftBlack != c.LineLeftWhite && c.LineRightBlack != c.LineRightWhite
+}
+
+// LineUnder tells from an analog reading of the left or right line sensor
+// whether it sees the line. Within the hysteresis band the previous answer,
+// 1 for a line, is kept.
+func (c *Calibration) LineUnder(sensor string, raw int, previous int) int {
+	towards := c.towardsBlack(sensor, raw)
+	switch {
+	case towards > c.LineHysteresis/2:
+		return 1
+	case towards < -c.LineHysteresis/2:
+		return 0
+	}
+	return previous
+}
+
+// Cliff tells from an analog reading of the left or right line sensor
+// whether it sees nothing to reflect its light at all.
+func (c *Calibration) Cliff(sensor string, raw int) bool {
+	return c.towardsBlack(sensor, raw) > 0.5+c.CliffMargin
+}
+
+// towardsBlack returns how far a line sensor reading is from the middle
+// between black and white, towards black, in parts of the range between
+// them. Black reads 0.5 and white -0.5.
+func (c *Calibration) towardsBlack(sensor string, raw int) float64 {
+	black, white := c.LineLeftBlack, c.LineLeftWhite
+	if sensor == "right" {
+		black, white = c.LineRightBlack, c.LineRightWhite
+	}
+	return (float64(raw) - (black+white)/2) / (black - white)
+}
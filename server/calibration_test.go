@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCalibrationSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		value float64
+		ok    bool
+	}{
+		{"rate", "cmPerStep", 1.5, true},
+		{"zero rate", "cmPerStep", 0, false},
+		{"negative turn rate", "leftDegreesPerMilli", -0.1, false},
+		{"zero spin rate", "rightSpinDegreesPerMilli", 0, false},
+		{"zero trim", "leftTrim", 0, true},
+		{"unknown", "wheelBase", 10, false},
+	}
+	for _, test := range tests {
+		cal := DefaultCalibration()
+		before := *cal
+		err := cal.Set(test.field, test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err %v, want ok %t", test.name, err, test.ok)
+		}
+		if err != nil && *cal != before {
+			t.Errorf("%s: calibration changed by an invalid value", test.name)
+		}
+	}
+}
+
+func TestCalibrationConversions(t *testing.T) {
+	cal := DefaultCalibration()
+	cal.CmPerStep = 2
+	cal.LeftDegreesPerMilli = 0.1
+	cal.RightSpinDegreesPerMilli = 0.5
+
+	steps := []struct {
+		cm   float64
+		want int
+	}{
+		{0, 0},
+		{10, 5},
+		{11, 6},
+		{10.9, 5},
+	}
+	for _, test := range steps {
+		if got := cal.StepsForDistance(test.cm); got != test.want {
+			t.Errorf("StepsForDistance(%v) = %d, want %d", test.cm, got, test.want)
+		}
+	}
+
+	millis := []struct {
+		degrees   float64
+		direction string
+		mode      string
+		want      int
+	}{
+		{90, "left", TurnPivot, 900},
+		{90, "right", TurnSpin, 180},
+		{0, "left", TurnPivot, 0},
+	}
+	for _, test := range millis {
+		if got := cal.MillisForAngle(test.degrees, test.direction, test.mode); got != test.want {
+			t.Errorf("MillisForAngle(%v, %s, %s) = %d, want %d", test.degrees, test.direction, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	for direction, want := range map[string]string{
+		"forward":  "backward",
+		"backward": "forward",
+		"left":     "right",
+		"right":    "left",
+	} {
+		if got := reverse(direction); got != want {
+			t.Errorf("reverse(%s) = %s, want %s", direction, got, want)
+		}
+	}
+}
+
+func TestCalibrationCliff(t *testing.T) {
+	cal := DefaultCalibration()
+	cal.LineLeftBlack, cal.LineLeftWhite = 800, 200
+	cal.LineRightBlack, cal.LineRightWhite = 700, 100
+
+	tests := []struct {
+		sensor string
+		raw    int
+		want   bool
+	}{
+		{"left", 200, false},
+		{"left", 800, false},
+		{"left", 1000, false},
+		{"left", 1200, true},
+		{"right", 1000, false},
+		{"right", 1100, true},
+	}
+	for _, test := range tests {
+		if got := cal.Cliff(test.sensor, test.raw); got != test.want {
+			t.Errorf("Cliff(%s, %d) = %t, want %t", test.sensor, test.raw, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+)
+
+// CliffBackoff is how far the rover backs away from a cliff, in cm
+const CliffBackoff = 10
+
+// checkCliff stops the rover when both line sensors lose their reflection
+// while it moves forward, which is what they do over the edge of a table.
+// A cliff reads beyond black, so only calibrated sensors can tell it from a
+// line. Must be called with s.mu held.
+func (s *Server) checkCliff() {
+	if !s.cliffGuard || !s.rover.Connected() {
+		return
+	}
+	if motion, moving := s.odometry.Motion(); !moving || motion.Speed <= 0 {
+		return
+	}
+
+	cal := s.rover.calibration
+	if !cal.LineCalibrated() {
+		return
+	}
+	left, right := s.sensors.LinesRaw()
+	if cal.Cliff("left", left) && cal.Cliff("right", right) {
+		s.stopAtCliff()
+	}
+}
+
+// stopAtCliff stops the rover, fails whatever moved it and backs away from
+// the edge. Must be called with s.mu held.
+func (s *Server) stopAtCliff() {
+	s.abortMotion("Cliff detected")
+	s.cliff = true
+	s.events.Publish("cliff", s.odometry.Pose())
+
+	// the backoff has no request of its own, its completion only updates
+	// the readings
+	if err := s.rover.wheels.DriveDistance("", "backward", CliffBackoff); err != nil {
+		fmt.Println("Could not back away from cliff - err ", err)
+	}
+}
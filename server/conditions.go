@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Sensors the device monitors read in the background.
+const (
+	SonarSensor string = "sonar"
+	LineSensors string = "line"
+	// LineStream is the line sensors streamed by the board, for conditions
+	// on edges that come and go between two readings
+	LineStream string = "lineStream"
+)
+
+// ConditionDistances are the distances the sonar condition blocks are
+// reported for, every whole cm the sonar measures, and ConditionSides the
+// choices of the Side menu of the line sensor ones. Scratch never asks for
+// hat and boolean blocks, it only reads them from the poll under their
+// selector and argument, so the server reports every argument a project
+// may give.
+var (
+	ConditionDistances = conditionDistances()
+	ConditionSides     = []string{"left", "right"}
+)
+
+func conditionDistances() (distances []string) {
+	for cm := 1; cm <= SonarMaxRange; cm++ {
+		distances = append(distances, strconv.Itoa(cm))
+	}
+	return
+}
+
+// Condition is a sensor threshold behind a Scratch hat or boolean block,
+// such as "when obstacle closer than 20 cm". Edge conditions, such as "when
+// line entered", are true once for every edge the sensors saw since the
+// condition was last tested. Conditions are tested on the last readings,
+// which are only kept current while the project watches the sensor.
+type Condition struct {
+	Selector string
+	Arg      string
+	test     func(st *SensorState) bool
+}
+
+// Watched maps the choices of the Watch menu to the sensor that is read in
+// the background while the project watches it.
+var Watched = map[string]string{
+	"sonar": SonarSensor,
+	// line conditions look for edges that come and go between two readings
+	"line": LineStream,
+}
+
+// CreateCondition builds the condition for a block selector and its argument.
+func CreateCondition(selector string, arg string) (Condition, error) {
+	cond := Condition{Selector: selector, Arg: arg}
+
+	switch selector {
+	case "whenObstacleCloser", "sonarCloser":
+		cm, err := strconv.Atoi(arg)
+		if err != nil {
+			return cond, fmt.Errorf("Invalid distance %s", arg)
+		}
+		cond.test = func(st *SensorState) bool {
+			return st.SonarRange() < cm
+		}
+	case "whenLine", "lineUnder":
+		if arg != "left" && arg != "right" {
+			return cond, fmt.Errorf("Invalid line sensor %s", arg)
+		}
+		cond.test = func(st *SensorState) bool {
+			left, right := st.Lines()
+			if arg == "left" {
+				return left == 1
+			}
+			return right == 1
+		}
+	case "whenLineEntered", "whenLineLeft":
+		if arg != "left" && arg != "right" {
+			return cond, fmt.Errorf("Invalid line sensor %s", arg)
+		}
+		key := LineEdge{Sensor: arg, Entered: selector == "whenLineEntered"}.Key()
+		// seen starts out unset, so that edges from before the condition
+		// was created do not count
+		seen := -1
+		cond.test = func(st *SensorState) bool {
+			count := st.LineEdges(key)
+			if seen < 0 || count <= seen {
+				seen = count
+				return false
+			}
+			seen = count
+			return true
+		}
+	default:
+		return cond, fmt.Errorf("Unknown condition %s", selector)
+	}
+	return cond, nil
+}
+
+// CreateConditions builds the condition of every block of the extension,
+// for every argument it is reported for, by Key.
+func CreateConditions() map[string]Condition {
+	args := map[string][]string{
+		"whenObstacleCloser": ConditionDistances,
+		"sonarCloser":        ConditionDistances,
+		"whenLine":           ConditionSides,
+		"lineUnder":          ConditionSides,
+		"whenLineEntered":    ConditionSides,
+		"whenLineLeft":       ConditionSides,
+	}
+	conditions := make(map[string]Condition)
+	for selector, choices := range args {
+		for _, arg := range choices {
+			cond, err := CreateCondition(selector, arg)
+			if err != nil {
+				panic(err)
+			}
+			conditions[cond.Key()] = cond
+		}
+	}
+	return conditions
+}
+
+// Key is the poll line name Scratch uses for a block with an argument.
+func (c Condition) Key() string {
+	return c.Selector + "/" + c.Arg
+}
+
+func (c Condition) Test(st *SensorState) bool {
+	return c.test(st)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCreateConditionsCoversMenus(t *testing.T) {
+	conditions := CreateConditions()
+	want := 2*len(ConditionDistances) + 4*len(ConditionSides)
+	if len(conditions) != want {
+		t.Fatalf("%d conditions, want %d", len(conditions), want)
+	}
+	for _, key := range []string{"whenObstacleCloser/12", "sonarCloser/35", "sonarCloser/200", "lineUnder/left", "whenLineLeft/right"} {
+		if _, ok := conditions[key]; !ok {
+			t.Errorf("no condition %s", key)
+		}
+	}
+}
+
+func TestSonarConditions(t *testing.T) {
+	conditions := CreateConditions()
+	st := NewSensorState()
+	st.Update(SonarReq{reqType: SonarRangeReq, Result: 18})
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"sonarCloser/15", false},
+		{"sonarCloser/18", false},
+		{"sonarCloser/19", true},
+		{"sonarCloser/20", true},
+		{"whenObstacleCloser/25", true},
+		{"whenObstacleCloser/10", false},
+	}
+	for _, tt := range tests {
+		if got := conditions[tt.key].Test(st); got != tt.want {
+			t.Errorf("%s = %t, want %t", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventBufferSize is how many events a slow client may fall behind by before
+// events to it are dropped
+const EventBufferSize = 64
+
+// Event is something that happened on the server, pushed to the clients of
+// the event stream.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// EventStream fans events out to every subscribed client.
+type EventStream struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+func NewEventStream() *EventStream {
+	return &EventStream{subscribers: make(map[chan Event]bool)}
+}
+
+// Publish sends an event to all subscribers. A subscriber that is not
+// keeping up misses the event rather than holding up the publisher.
+func (es *EventStream) Publish(eventType string, data interface{}) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+	for ch := range es.subscribers {
+		select {
+		case ch <- event:
+		default:
+			fmt.Println("Events: dropping ", eventType, " event for a slow client")
+		}
+	}
+}
+
+func (es *EventStream) Subscribe() chan Event {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	ch := make(chan Event, EventBufferSize)
+	es.subscribers[ch] = true
+	return ch
+}
+
+func (es *EventStream) Unsubscribe(ch chan Event) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	delete(es.subscribers, ch)
+}
+
+// ServeHTTP streams the events as server-sent events, one JSON encoded Event
+// per message, until the client goes away.
+func (es *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	flusher.Flush()
+
+	ch := es.Subscribe()
+	defer es.Unsubscribe(ch)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				fmt.Println("Events: could not encode ", event.Type, " event - err ", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
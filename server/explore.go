@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ExploreTask = "explore"
+
+	// ExploreStopRange is how close the rover gets to an obstacle before
+	// looking for a way around it, in cm
+	ExploreStopRange = 25
+	// ExploreSweepStep is the angle between the readings of the scan made at
+	// an obstacle
+	ExploreSweepStep = 15
+)
+
+// Explore drives the rover around on its own. It runs forward until an
+// obstacle is closer than stopRange, then scans with the sonar and spins
+// towards the clearest direction, or turns around if there is none. It goes
+// on until the task is stopped, which any manual motion command does.
+func (s *Server) Explore(t *Task, stopRange int, speed int) (err error) {
+	defer func() {
+		// a stopped task has handed the wheels over to whoever stopped it
+		if err != nil && err != ErrTaskStopped {
+			s.stopWheels()
+		}
+	}()
+
+	if _, err := TurnSonarTo(t, 0); err != nil {
+		return err
+	}
+	for {
+		if err := t.Do(func(r *Rover) error {
+			if speed <= 0 {
+				return r.wheels.RunDefault("forward")
+			}
+			return r.wheels.Run("forward", speed, speed)
+		}); err != nil {
+			return err
+		}
+		for {
+			value, err := ReadSonarRange(t)
+			if err != nil {
+				return err
+			}
+			if value < stopRange {
+				break
+			}
+		}
+		if err := t.Do(func(r *Rover) error {
+			return r.wheels.Stop()
+		}); err != nil {
+			return err
+		}
+
+		scan, err := s.ScanSonar(t, ExploreSweepStep)
+		if err != nil {
+			return err
+		}
+		angle := float64(scan.ClearestAngle)
+		if scan.ClearestRange <= stopRange {
+			fmt.Println("Explore: boxed in, turning around")
+			angle = 180
+		}
+		fmt.Println("Explore: obstacle ahead, turning ", angle)
+		if err := TurnBy(t, angle, TurnSpin); err != nil {
+			return err
+		}
+	}
+}
+
+// TurnBy turns the rover by degrees, positive to the right, and waits for
+// the turn to finish.
+func TurnBy(t *Task, degrees float64, mode string) error {
+	direction := "right"
+	if degrees < 0 {
+		direction, degrees = "left", -degrees
+	}
+
+	t.server.mu.Lock()
+	millis := t.server.rover.calibration.MillisForAngle(degrees, direction, mode)
+	t.server.mu.Unlock()
+
+	_, err := t.Call(func(r *Rover, id string) error {
+		return r.wheels.TurnAngle(id, direction, mode, degrees)
+	}, 1, time.Duration(millis)*time.Millisecond+RequestTimeoutMargin)
+	return err
+}
+
+// DriveBy drives cm forward, or backward if cm is negative, and waits for the
+// rover to get there.
+func DriveBy(t *Task, cm float64) error {
+	direction := "forward"
+	if cm < 0 {
+		direction, cm = "backward", -cm
+	}
+
+	t.server.mu.Lock()
+	steps := t.server.rover.calibration.StepsForDistance(cm)
+	t.server.mu.Unlock()
+
+	_, err := t.Call(func(r *Rover, id string) error {
+		return r.wheels.DriveDistance(id, direction, cm)
+	}, 1, time.Duration(steps)*StepTime+RequestTimeoutMargin)
+	return err
+}
+
+// stopWheels stops the rover outside of any task, after a task failed while
+// the wheels were running.
+func (s *Server) stopWheels() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		return
+	}
+	if err := s.rover.wheels.Stop(); err != nil {
+		fmt.Println("Could not stop the wheels - err ", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sparkybots/sparky/server/board"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeConn stands in for the serial link to the board. It records the
+// messages the server writes and answers the protocol version query, so
+// that a board can be connected without the firmware.
+type fakeConn struct {
+	mutex      sync.Mutex
+	connecting bool
+	written    [][]byte
+	replies    []byte
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.written = append(c.written, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// Read answers with the protocol version until the board is connected, and
+// with nothing after that.
+func (c *fakeConn) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.replies) == 0 && c.connecting {
+		c.replies = append(c.replies, board.ProtocolVersion, 2, 5)
+	}
+	if len(c.replies) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.replies)
+	c.replies = c.replies[n:]
+	return n, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// commands returns the rover commands of kind written since the last call,
+// as the bytes between the command and the end of the sysex message.
+func (c *fakeConn) commands(kind byte, sub byte) (commands [][]byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, msg := range c.written {
+		if bytes.HasPrefix(msg, []byte{board.StartSysex, kind, sub}) {
+			commands = append(commands, msg[3:len(msg)-1])
+		}
+	}
+	c.written = nil
+	return
+}
+
+// testRover returns a rover connected to a fake board, answering to respQ.
+func testRover(t *testing.T, respQ chan Work, cal *Calibration, odometry *Odometry) (Rover, *fakeConn) {
+	conn := &fakeConn{connecting: true}
+	b := board.New()
+	if err := b.Connect(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.mutex.Lock()
+	conn.connecting, conn.replies, conn.written = false, nil, nil
+	conn.mutex.Unlock()
+
+	return Rover{
+		board:       b,
+		calibration: cal,
+		sonar:       CreateSonar(b, respQ, cal),
+		buzzer:      CreateBuzzer(b, respQ),
+		wheels:      CreateWheels(b, respQ, cal, odometry),
+		lineSensor:  CreateLineSensor(b, respQ, cal),
+	}, conn
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+)
+
+const GridNavigationTask = "grid navigation"
+
+// GridPosition is where the rover stands on a grid of taped lines. Cells
+// are counted in intersections from where the position was last set, with
+// x to the right and y ahead of the heading at that point, as for the pose.
+// Heading is 0, 90, 180 or 270 degrees clockwise.
+type GridPosition struct {
+	X       int `json:"x"`
+	Y       int `json:"y"`
+	Heading int `json:"heading"`
+}
+
+// Forward returns the position one cell ahead.
+func (gp GridPosition) Forward() GridPosition {
+	switch gp.Heading {
+	case 0:
+		gp.Y++
+	case 90:
+		gp.X++
+	case 180:
+		gp.Y--
+	case 270:
+		gp.X--
+	}
+	return gp
+}
+
+// Turned returns the position after turning by degrees, a multiple of 90.
+func (gp GridPosition) Turned(degrees int) GridPosition {
+	gp.Heading = ((gp.Heading+degrees)%360 + 360) % 360
+	return gp
+}
+
+// gridPosition returns where the rover stands on the grid.
+func (s *Server) gridPosition() GridPosition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.gridNav
+}
+
+// setGridPosition records where the rover stands and publishes it.
+func (s *Server) setGridPosition(gp GridPosition) {
+	s.mu.Lock()
+	s.gridNav = gp
+	s.mu.Unlock()
+
+	fmt.Println("Grid: at cell ", gp.X, gp.Y, " heading ", gp.Heading)
+	s.events.Publish("cell", gp)
+}
+
+// GridForward follows the line for cells intersections, stopping on the
+// last one. The rover has to start on an intersection, or on the line
+// facing the first one.
+func (s *Server) GridForward(t *Task, settings LineFollowSettings, cells int) error {
+	for i := 0; i < cells; i++ {
+		if err := s.nextIntersection(t, settings); err != nil {
+			return err
+		}
+		s.setGridPosition(s.gridPosition().Forward())
+	}
+	return nil
+}
+
+// GridTurn follows the line to the next intersection and turns there, by
+// degrees to the right.
+func (s *Server) GridTurn(t *Task, settings LineFollowSettings, degrees int) error {
+	if err := s.GridForward(t, settings, 1); err != nil {
+		return err
+	}
+	return s.gridTurnInPlace(t, degrees)
+}
+
+// GridGoTo drives to cell x, y, first along the x axis and then along the
+// y axis, turning on the intersections on the way.
+func (s *Server) GridGoTo(t *Task, settings LineFollowSettings, x int, y int) error {
+	from := s.gridPosition()
+	legs := []struct {
+		cells   int
+		heading int
+	}{
+		{x - from.X, 90},
+		{y - from.Y, 0},
+	}
+	for _, leg := range legs {
+		if leg.cells == 0 {
+			continue
+		}
+		heading := leg.heading
+		if leg.cells < 0 {
+			heading, leg.cells = heading+180, -leg.cells
+		}
+		turn := ((heading-s.gridPosition().Heading)%360 + 360) % 360
+		if turn == 270 {
+			turn = -90
+		}
+		if err := s.gridTurnInPlace(t, turn); err != nil {
+			return err
+		}
+		if err := s.GridForward(t, settings, leg.cells); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gridTurnInPlace spins on an intersection by degrees to the right.
+func (s *Server) gridTurnInPlace(t *Task, degrees int) error {
+	if degrees == 0 {
+		return nil
+	}
+	if err := TurnBy(t, float64(degrees), TurnSpin); err != nil {
+		return err
+	}
+	s.setGridPosition(s.gridPosition().Turned(degrees))
+	return nil
+}
+
+// nextIntersection follows the line until both line sensors see a line and
+// then drives on to stand with the wheels on the intersection. Starting on
+// an intersection, the follower first has to leave it.
+func (s *Server) nextIntersection(t *Task, settings LineFollowSettings) error {
+	left, right, err := ReadLines(t)
+	if err != nil {
+		return err
+	}
+	if left == 1 && right == 1 {
+		if err := s.followLine(t, settings, func(left int, right int) bool {
+			return left == 0 || right == 0
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := s.followLine(t, settings, func(left int, right int) bool {
+		return left == 1 && right == 1
+	}); err != nil {
+		return err
+	}
+	if settings.IntersectionOffset > 0 {
+		return DriveBy(t, settings.IntersectionOffset)
+	}
+	return t.Do(func(r *Rover) error {
+		return r.wheels.Stop()
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// LineCalibrationSamples is how many readings are averaged per surface
+	LineCalibrationSamples = 10
+	LineCalibrationPause   = 20 * time.Millisecond
+)
+
+// CalibrateLine averages the analog readings of both line sensors held over
+// surface, black or white, and keeps them in the robot's calibration
+// profile. The thresholds apply once both surfaces have been sampled.
+func (s *Server) CalibrateLine(t *Task, surface string) error {
+	left, right := 0, 0
+	for i := 0; i < LineCalibrationSamples; i++ {
+		resps, err := t.Call(func(r *Rover, id string) error {
+			return r.lineSensor.ReadRaw(id)
+		}, 2, RequestTimeoutMargin)
+		if err != nil {
+			return err
+		}
+		for _, resp := range resps {
+			if resp.GetType() == LineLeftResp {
+				left += resp.(LineSensorReq).Raw
+			} else {
+				right += resp.(LineSensorReq).Raw
+			}
+		}
+		if err := t.Sleep(LineCalibrationPause); err != nil {
+			return err
+		}
+	}
+	leftAverage := float64(left) / LineCalibrationSamples
+	rightAverage := float64(right) / LineCalibrationSamples
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cal := s.rover.calibration
+	if surface == "black" {
+		cal.LineLeftBlack, cal.LineRightBlack = leftAverage, rightAverage
+	} else {
+		cal.LineLeftWhite, cal.LineRightWhite = leftAverage, rightAverage
+	}
+	fmt.Println("Line calibration: ", surface, " reads ", leftAverage, rightAverage, " calibrated ", cal.LineCalibrated())
+	s.saveProfiles()
+	// a stream switches to analog readings once calibrated
+	s.updateMonitors()
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	LineFollowTask = "line follow"
+
+	// what the line follower does once it has lost the line
+	LineRecoveryStop    = "stop"
+	LineRecoverySearch  = "search"
+	LineRecoveryReverse = "reverse"
+)
+
+// LineFollowSettings tune the line follower. The sensors are expected to
+// straddle the line, so that the line only shows under a sensor when the
+// rover drifts off it. Steering is in percent of wheel speed, applied per
+// unit of error, where the error is -1 with the line under the left sensor
+// and 1 with it under the right one.
+type LineFollowSettings struct {
+	// Speed is the forward speed in percent
+	Speed int `json:"speed"`
+	// Kp and Kd are the proportional and derivative gains. The derivative
+	// is taken per second.
+	Kp float64 `json:"kp"`
+	Kd float64 `json:"kd"`
+	// LostTime is how long, in seconds, neither sensor may see the line
+	// before the line counts as lost. As neither sees it either while the
+	// rover is right on the line, it has to be longer than the rover takes
+	// to drift off a straight line.
+	LostTime float64 `json:"lostTime"`
+	// Recovery is one of the LineRecovery strategies
+	Recovery string `json:"recovery"`
+	// SearchTime is how long, in seconds, a recovery looks for the line
+	// before the follower gives up
+	SearchTime float64 `json:"searchTime"`
+	// IntersectionOffset is how far the line sensors are ahead of the
+	// wheels, in cm, which is how far grid navigation drives on after
+	// finding an intersection to stand on it
+	IntersectionOffset float64 `json:"intersectionOffset"`
+}
+
+func DefaultLineFollowSettings() LineFollowSettings {
+	return LineFollowSettings{
+		Speed:      40,
+		Kp:         40,
+		Kd:         2,
+		LostTime:   3,
+		Recovery:   LineRecoverySearch,
+		SearchTime: 3,
+
+		IntersectionOffset: 5,
+	}
+}
+
+// Set changes the setting with the given JSON name. Recovery is set by name
+// with SetRecovery.
+func (lf *LineFollowSettings) Set(field string, value float64) error {
+	switch field {
+	case "speed":
+		lf.Speed = int(value)
+	case "kp":
+		lf.Kp = value
+	case "kd":
+		lf.Kd = value
+	case "lostTime":
+		lf.LostTime = value
+	case "searchTime":
+		lf.SearchTime = value
+	case "intersectionOffset":
+		lf.IntersectionOffset = value
+	default:
+		return fmt.Errorf("Unknown line follow setting %s", field)
+	}
+	return nil
+}
+
+func (lf *LineFollowSettings) SetRecovery(recovery string) error {
+	switch recovery {
+	case LineRecoveryStop, LineRecoverySearch, LineRecoveryReverse:
+		lf.Recovery = recovery
+		return nil
+	}
+	return fmt.Errorf("Unknown line recovery %s", recovery)
+}
+
+// FollowLine runs the line follower until the task is stopped, or until the
+// line is lost for good.
+func (s *Server) FollowLine(t *Task, settings LineFollowSettings) (err error) {
+	defer func() {
+		if err != nil && err != ErrTaskStopped {
+			s.stopWheels()
+		}
+	}()
+
+	return s.followLine(t, settings, func(left int, right int) bool {
+		return false
+	})
+}
+
+// followLine follows the line until done is true for a reading of the line
+// sensors, leaving the wheels running. Each round reads the line sensors
+// and steers with the outcome, so the loop runs as fast as the board
+// answers.
+func (s *Server) followLine(t *Task, settings LineFollowSettings, done func(left int, right int) bool) error {
+	// lastSide is the error when the line was last seen, telling the
+	// recovery where to look
+	lastError, lastSide, lastSeen := 0.0, 0.0, time.Now()
+	lastRead, lastAngular := time.Now(), 0
+	steering := false
+	for {
+		left, right, err := ReadLines(t)
+		if err != nil {
+			return err
+		}
+		if done(left, right) {
+			return nil
+		}
+		now := time.Now()
+
+		lineError := float64(right - left)
+		if left == 1 || right == 1 {
+			lastSeen = now
+		} else if now.Sub(lastSeen).Seconds() > settings.LostTime {
+			fmt.Println("Line follow: lost the line, recovery ", settings.Recovery)
+			if err := s.recoverLine(t, settings, lastSide); err != nil {
+				return err
+			}
+			lastError, lastSeen, lastRead, steering = 0, time.Now(), time.Now(), false
+			continue
+		}
+
+		steer := settings.Kp * lineError
+		if dt := now.Sub(lastRead).Seconds(); dt > 0 {
+			steer += settings.Kd * (lineError - lastError) / dt
+		}
+		if lineError != 0 {
+			lastSide = lineError
+		}
+		lastError, lastRead = lineError, now
+
+		// the wheels are only told when the steering changes, to keep the
+		// serial link free for the sensor readings
+		angular := int(steer)
+		if steering && angular == lastAngular {
+			continue
+		}
+		if err := t.Do(func(r *Rover) error {
+			return r.wheels.Curve(settings.Speed, angular)
+		}); err != nil {
+			return err
+		}
+		steering, lastAngular = true, angular
+	}
+}
+
+// recoverLine looks for a lost line as settings say, lastSide telling which
+// side it was last seen on.
+func (s *Server) recoverLine(t *Task, settings LineFollowSettings, lastSide float64) error {
+	var search func(r *Rover) error
+	switch settings.Recovery {
+	case LineRecoverySearch:
+		// spin towards the side the line was last seen on
+		search = func(r *Rover) error {
+			if lastSide < 0 {
+				return r.wheels.Drive(-settings.Speed, settings.Speed)
+			}
+			return r.wheels.Drive(settings.Speed, -settings.Speed)
+		}
+	case LineRecoveryReverse:
+		search = func(r *Rover) error {
+			return r.wheels.Drive(-settings.Speed, -settings.Speed)
+		}
+	default:
+		return fmt.Errorf("Line follow: lost the line")
+	}
+
+	if err := t.Do(search); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Duration(settings.SearchTime * float64(time.Second)))
+	for time.Now().Before(deadline) {
+		left, right, err := ReadLines(t)
+		if err != nil {
+			return err
+		}
+		if left == 1 || right == 1 {
+			fmt.Println("Line follow: found the line again")
+			return nil
+		}
+	}
+	return fmt.Errorf("Line follow: lost the line")
+}
@@ -5,24 +5,39 @@ import (
 	"github.com/sparkybots/gobot"
 	"github.com/sparkybots/sparky/server/board"
 	"strconv"
+	"time"
 )
 
 const (
 	LineReq       string = "LINE"
 	LineLeftResp  string = "LINE_LEFT"
 	LineRightResp string = "LINE_RIGHT"
+
+	// LineMonitorInterval is how often the line sensors are read in the background
+	LineMonitorInterval = 100 * time.Millisecond
 )
 
 type LineSensor struct {
-	board     *board.Board
-	reqQueue  chan LineSensorReq
-	respQueue chan Work
+	board       *board.Board
+	reqQueue    *RequestQueue
+	respQueue   chan Work
+	monitor     *Monitor
+	calibration *Calibration
+	// streamMode is the board's line stream mode
+	streamMode byte
+	// left and right are the last readings, 1 for a line
+	left  int
+	right int
 }
 
+// LineSensorReq is a request for the line sensors, answered with one
+// response per sensor. Raw is the sensor's analog reading, or -1 if the
+// board was asked for a digital reading.
 type LineSensorReq struct {
 	ID      string
 	ReqType string
 	Result  int
+	Raw     int
 }
 
 func (r LineSensorReq) GetID() string {
@@ -37,30 +52,151 @@ func (r LineSensorReq) GetRespValue() string {
 	return strconv.Itoa(r.Result)
 }
 
-func CreateLineSensor(b *board.Board, respQ chan Work) LineSensor {
+func CreateLineSensor(b *board.Board, respQ chan Work, cal *Calibration) *LineSensor {
 
-	sensor := LineSensor{
-		board:     b,
-		reqQueue:  make(chan LineSensorReq, 100),
-		respQueue: respQ,
+	sensor := &LineSensor{
+		board:       b,
+		reqQueue:    NewRequestQueue(),
+		respQueue:   respQ,
+		monitor:     NewMonitor(),
+		calibration: cal,
 	}
 
 	gobot.On(b.Event("RoverLineResponse"), sensor.processLineResponse)
+	gobot.On(b.Event("RoverLineEvent"), sensor.processLineEvent)
+	gobot.On(b.Event("RoverLineAnalogResponse"), sensor.processLineAnalogResponse)
+	gobot.On(b.Event("RoverLineAnalogEvent"), sensor.processLineAnalogEvent)
 	return sensor
 }
 
+// readLineSensors reads whether the sensors see a line. Once the sensors are
+// calibrated, this is decided from their analog readings.
 func (l *LineSensor) readLineSensors(id string) error {
-	req := LineSensorReq{ID: id, ReqType: LineReq, Result: 0}
-	l.reqQueue <- req
-	return l.board.RoverReadLineSensors()
+	if l.calibration.LineCalibrated() {
+		return l.ReadRaw(id)
+	}
+	req := LineSensorReq{ID: id, ReqType: LineReq, Result: 0, Raw: -1}
+	l.reqQueue.Push(req, 0)
+	err := l.board.RoverReadLineSensors()
+	if err != nil {
+		l.reqQueue.Remove(req)
+	}
+	return err
+}
+
+// ReadRaw reads the analog readings of the sensors.
+func (l *LineSensor) ReadRaw(id string) error {
+	req := LineSensorReq{ID: id, ReqType: LineReq, Result: 0, Raw: -1}
+	l.reqQueue.Push(req, 0)
+	err := l.board.RoverReadLineAnalog()
+	if err != nil {
+		l.reqQueue.Remove(req)
+	}
+	return err
 }
 
 func (l *LineSensor) processLineResponse(data interface{}) {
-	req := <-l.reqQueue
-	val := data.(uint8)
-	lResp := LineSensorReq{ID: req.GetID(), ReqType: LineLeftResp, Result: int(^val & 0x01)}
-	rResp := LineSensorReq{ID: req.GetID(), ReqType: LineRightResp, Result: int(^(val >> 1) & 0x01)}
-	l.respQueue <- lResp
-	l.respQueue <- rResp
-	fmt.Println("LineSensor: Got line response, assigning to ID ", req.ID)
+	req, ok := l.reqQueue.Pop()
+	if !ok {
+		fmt.Println("LineSensor: Discarding line response with no pending request")
+		return
+	}
+	l.sendDigital(req.GetID(), data.(uint8))
+	fmt.Println("LineSensor: Got line response, assigning to ID ", req.GetID())
+}
+
+// processLineEvent passes on a change of the line sensors streamed by the
+// board, as readings with an empty ID.
+func (l *LineSensor) processLineEvent(data interface{}) {
+	l.sendDigital("", data.(uint8))
+}
+
+func (l *LineSensor) processLineAnalogResponse(data interface{}) {
+	req, ok := l.reqQueue.Pop()
+	if !ok {
+		fmt.Println("LineSensor: Discarding analog line response with no pending request")
+		return
+	}
+	values := data.([]int)
+	l.sendAnalog(req.GetID(), values[0], values[1])
+	fmt.Println("LineSensor: Got analog line response ", values, " assigning to ID ", req.GetID())
+}
+
+func (l *LineSensor) processLineAnalogEvent(data interface{}) {
+	values := data.([]int)
+	l.sendAnalog("", values[0], values[1])
+}
+
+// sendDigital answers id with the board's digital readings, in which a line
+// reads as 0.
+func (l *LineSensor) sendDigital(id string, val uint8) {
+	l.left, l.right = int(^val&0x01), int(^(val>>1)&0x01)
+	l.respQueue <- LineSensorReq{ID: id, ReqType: LineLeftResp, Result: l.left, Raw: -1}
+	l.respQueue <- LineSensorReq{ID: id, ReqType: LineRightResp, Result: l.right, Raw: -1}
+}
+
+// sendAnalog answers id with analog readings, deciding with the calibrated
+// thresholds whether they show a line. Uncalibrated sensors keep their last
+// digital reading.
+func (l *LineSensor) sendAnalog(id string, left int, right int) {
+	if l.calibration.LineCalibrated() {
+		l.left = l.calibration.LineUnder("left", left, l.left)
+		l.right = l.calibration.LineUnder("right", right, l.right)
+	}
+	l.respQueue <- LineSensorReq{ID: id, ReqType: LineLeftResp, Result: l.left, Raw: left}
+	l.respQueue <- LineSensorReq{ID: id, ReqType: LineRightResp, Result: l.right, Raw: right}
+}
+
+// Stream turns on or off the board sending every change of the line
+// sensors, which catches lines too narrow to be seen between two readings.
+// Calibrated sensors stream their analog readings.
+func (l *LineSensor) Stream(on bool) error {
+	mode := board.LineStreamOff
+	if on && l.calibration.LineCalibrated() {
+		mode = board.LineStreamAnalog
+	} else if on {
+		mode = board.LineStreamDigital
+	}
+	if mode == l.streamMode {
+		return nil
+	}
+	if err := l.board.RoverLineStream(mode); err != nil {
+		return fmt.Errorf("Error sending line stream request to board err - %s ", err)
+	}
+	fmt.Println("LineSensor: stream mode ", mode)
+	l.streamMode = mode
+	return nil
+}
+
+func (l *LineSensor) Streaming() bool {
+	return l.streamMode != board.LineStreamOff
+}
+
+// StreamReset records that the board stopped streaming when it was reset.
+func (l *LineSensor) StreamReset() {
+	l.streamMode = board.LineStreamOff
+}
+
+// StartMonitor reads the line sensors in the background, skipping a reading
+// while the previous one is outstanding. Background readings have an empty ID.
+func (l *LineSensor) StartMonitor() {
+	l.monitor.Start(LineMonitorInterval, func() {
+		if l.reqQueue.Len() == 0 {
+			if err := l.readLineSensors(""); err != nil {
+				fmt.Println("LineSensor: monitor err - ", err)
+			}
+		}
+	})
+}
+
+func (l *LineSensor) StopMonitor() {
+	l.monitor.Stop()
+}
+
+func (l *LineSensor) FlushRequests() {
+	l.reqQueue.Flush()
+}
+
+func (l *LineSensor) ExpireRequests(now time.Time) []Work {
+	return l.reqQueue.Expire(now)
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Monitor calls a poll function periodically in the background until it is
+// stopped. Devices use it to keep readings fresh without Scratch asking.
+type Monitor struct {
+	mutex sync.Mutex
+	stop  chan struct{}
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{}
+}
+
+// Start begins calling poll every interval. It does nothing if the monitor
+// is already running.
+func (m *Monitor) Start(interval time.Duration, poll func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	m.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				poll()
+			}
+		}
+	}()
+}
+
+func (m *Monitor) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+func (m *Monitor) Running() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.stop != nil
+}
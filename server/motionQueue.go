@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// states of the wheels. Running is an open ended motion, Run or Drive,
+	// stepping and turning are motions timed by the firmware.
+	MotionIdle     = "idle"
+	MotionRunning  = "running"
+	MotionStepping = "stepping"
+	MotionTurning  = "turning"
+	// stopping is an open ended motion slowing down to a stop
+	MotionStopping = "stopping"
+
+	// policies for a motion command arriving while a step or turn is in
+	// progress. An open ended motion in progress is always replaced.
+	MotionWait    = "wait"
+	MotionReplace = "replace"
+	MotionReject  = "reject"
+)
+
+// MotionQueue is the motion state of the wheels, which both the commands
+// and the board events move on. Its mutex is held while a motion starts.
+type MotionQueue struct {
+	mutex  sync.Mutex
+	state  string
+	policy string
+	// seq numbers the motions as they start, the last one being the motion
+	// in progress. Responses to earlier motions, which were replaced or
+	// stopped, do not move the queue on.
+	seq     int
+	pending []queuedMotion
+	// limit scales the speed of the open ended motions down from 1. drive
+	// keeps the untrimmed, unlimited PWM duties of the one in progress, so
+	// that it can be limited again.
+	limit float64
+	drive [2]int
+	// current are the untrimmed PWM duties the wheels were last given for
+	// an open ended motion, and target the ones the ramp heads for
+	current [2]int
+	target  [2]int
+	ramp    *Monitor
+}
+
+// queuedMotion is a motion command waiting for the step or turn in
+// progress. start sends it to the board once req has its sequence number.
+type queuedMotion struct {
+	req   WheelsReq
+	state string
+	start func(req WheelsReq) error
+}
+
+func NewMotionQueue() *MotionQueue {
+	return &MotionQueue{state: MotionIdle, policy: MotionWait, limit: 1, ramp: NewMonitor()}
+}
+
+// State returns the state of the wheels and the number of motions waiting.
+func (wh *Wheels) State() (string, int) {
+	wh.motion.mutex.Lock()
+	defer wh.motion.mutex.Unlock()
+
+	return wh.motion.state, len(wh.motion.pending)
+}
+
+// SetPolicy sets what happens to a motion command arriving while a step or
+// turn is in progress.
+func (wh *Wheels) SetPolicy(policy string) error {
+	switch policy {
+	case MotionWait, MotionReplace, MotionReject:
+	default:
+		return fmt.Errorf("Unknown motion policy %s", policy)
+	}
+
+	wh.motion.mutex.Lock()
+	defer wh.motion.mutex.Unlock()
+
+	wh.motion.policy = policy
+	return nil
+}
+
+func (wh *Wheels) Policy() string {
+	wh.motion.mutex.Lock()
+	defer wh.motion.mutex.Unlock()
+
+	return wh.motion.policy
+}
+
+// submit starts a motion, in state once started, or queues or rejects it as
+// the policy says when a step or turn is in progress. A replaced step or
+// turn is answered by the firmware when the new motion reaches it.
+func (wh *Wheels) submit(req WheelsReq, state string, start func(req WheelsReq) error) error {
+	m := wh.motion
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.state == MotionStepping || m.state == MotionTurning {
+		switch m.policy {
+		case MotionReject:
+			return fmt.Errorf("Wheels are busy %s, rejected request id %s", m.state, req.ID)
+		case MotionWait:
+			m.pending = append(m.pending, queuedMotion{req: req, state: state, start: start})
+			fmt.Println("Wheels: queued ", state, " request id : ", req.ID, " behind ", len(m.pending)-1)
+			return nil
+		}
+		wh.completePending()
+	}
+	return wh.start(queuedMotion{req: req, state: state, start: start})
+}
+
+// start sends a motion to the board. Must be called with the motion mutex
+// held.
+func (wh *Wheels) start(q queuedMotion) error {
+	m := wh.motion
+	m.seq++
+	q.req.seq = m.seq
+	if q.state != MotionRunning {
+		// the firmware runs steps and turns at full speed and leaves the
+		// wheels stopped
+		m.ramp.Stop()
+		m.current = [2]int{}
+	}
+	m.state = q.state
+	if err := q.start(q.req); err != nil {
+		m.state = MotionIdle
+		return err
+	}
+	return nil
+}
+
+// motionDone answers the motion a response from queue belongs to. The last
+// chunk of the motion in progress starts the next motion waiting, earlier
+// chunks send the next chunk.
+func (wh *Wheels) motionDone(queue *RequestQueue, kind string) {
+	req, ok := queue.Pop()
+	if !ok {
+		fmt.Println("Wheels: Discarding ", kind, " response with no pending request")
+		return
+	}
+
+	m := wh.motion
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	wreq := req.(WheelsReq)
+	current := wreq.seq == m.seq
+	if current && wreq.remaining > 0 {
+		if err := wh.sendChunk(queue, wreq); err != nil {
+			fmt.Println("Wheels: could not send next chunk of request id : ", wreq.ID, " err - ", err)
+			wh.next()
+		}
+		return
+	}
+	wh.respond(req)
+	if current {
+		wh.next()
+	}
+}
+
+// next starts the first motion waiting, or leaves the wheels idle. Must be
+// called with the motion mutex held.
+func (wh *Wheels) next() {
+	m := wh.motion
+	m.state = MotionIdle
+	for len(m.pending) > 0 {
+		q := m.pending[0]
+		m.pending = m.pending[1:]
+		if err := wh.start(q); err != nil {
+			fmt.Println("Wheels: could not start queued request id : ", q.req.ID, " err - ", err)
+			continue
+		}
+		return
+	}
+}
+
+// completePending answers the motions waiting without running them. Must be
+// called with the motion mutex held.
+func (wh *Wheels) completePending() {
+	for _, q := range wh.motion.pending {
+		if q.req.ID != "" {
+			wh.respond(q.req)
+		}
+	}
+	wh.motion.pending = nil
+}
+
+// forget leaves the wheels idle, forgetting the motion in progress and
+// returning the motions waiting. Must be called with the motion mutex held.
+func (wh *Wheels) forget() (pending []Work) {
+	m := wh.motion
+	for _, q := range m.pending {
+		pending = append(pending, q.req)
+	}
+	m.pending = nil
+	m.seq++
+	m.state = MotionIdle
+	return
+}
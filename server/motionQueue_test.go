@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testWheels returns wheels whose motions are only queued as sent, so that
+// the motion queue can be driven without a board.
+func testWheels(policy string) *Wheels {
+	wh := &Wheels{
+		stepReqQueue: NewRequestQueue(),
+		respQueue:    make(chan Work, 10),
+		motion:       NewMotionQueue(),
+	}
+	wh.SetPolicy(policy)
+	return wh
+}
+
+// submitStep submits a step of the given ID that the test answers with
+// motionDone.
+func submitStep(wh *Wheels, id string, state string) error {
+	return wh.submit(WheelsReq{ID: id, ReqType: WheelsStepReq}, state, func(req WheelsReq) error {
+		wh.stepReqQueue.Push(req, 0)
+		return nil
+	})
+}
+
+// answered returns the IDs of the requests answered so far.
+func answered(wh *Wheels) (ids []string) {
+	for {
+		select {
+		case w := <-wh.respQueue:
+			ids = append(ids, w.GetID())
+		default:
+			return
+		}
+	}
+}
+
+func TestMotionQueue(t *testing.T) {
+	type step struct {
+		// submit is the ID of a motion to submit, or empty for the board to
+		// answer the oldest motion sent
+		submit   string
+		state    string
+		rejected bool
+		// after is the state and the motions waiting afterwards, and the
+		// requests answered by the step
+		after    string
+		waiting  int
+		answered []string
+	}
+	tests := []struct {
+		policy string
+		steps  []step
+	}{
+		{MotionWait, []step{
+			{submit: "1", state: MotionStepping, after: MotionStepping},
+			{submit: "2", state: MotionTurning, after: MotionStepping, waiting: 1},
+			{submit: "3", state: MotionStepping, after: MotionStepping, waiting: 2},
+			{after: MotionTurning, waiting: 1, answered: []string{"1"}},
+			{after: MotionStepping, answered: []string{"2"}},
+			{after: MotionIdle, answered: []string{"3"}},
+		}},
+		{MotionReject, []step{
+			{submit: "1", state: MotionStepping, after: MotionStepping},
+			{submit: "2", state: MotionTurning, rejected: true, after: MotionStepping},
+			{after: MotionIdle, answered: []string{"1"}},
+			{submit: "3", state: MotionTurning, after: MotionTurning},
+			{after: MotionIdle, answered: []string{"3"}},
+		}},
+		{MotionReplace, []step{
+			{submit: "1", state: MotionStepping, after: MotionStepping},
+			{submit: "2", state: MotionTurning, after: MotionTurning},
+			// the replaced step is answered without moving the queue on
+			{after: MotionTurning, answered: []string{"1"}},
+			{after: MotionIdle, answered: []string{"2"}},
+		}},
+	}
+	for _, test := range tests {
+		wh := testWheels(test.policy)
+		for i, s := range test.steps {
+			if s.submit != "" {
+				err := submitStep(wh, s.submit, s.state)
+				if (err != nil) != s.rejected {
+					t.Errorf("%s step %d: err %v, want rejected %t", test.policy, i, err, s.rejected)
+				}
+			} else {
+				wh.motionDone(wh.stepReqQueue, "step")
+			}
+			state, waiting := wh.State()
+			if state != s.after || waiting != s.waiting {
+				t.Errorf("%s step %d: %s with %d waiting, want %s with %d", test.policy, i, state, waiting, s.after, s.waiting)
+			}
+			if got := answered(wh); !reflect.DeepEqual(got, s.answered) {
+				t.Errorf("%s step %d: answered %v, want %v", test.policy, i, got, s.answered)
+			}
+		}
+	}
+}
+
+func TestMotionQueueForget(t *testing.T) {
+	wh := testWheels(MotionWait)
+	submitStep(wh, "1", MotionStepping)
+	submitStep(wh, "2", MotionTurning)
+
+	wh.motion.mutex.Lock()
+	pending := wh.forget()
+	wh.motion.mutex.Unlock()
+	if len(pending) != 1 || pending[0].GetID() != "2" {
+		t.Errorf("forgot %v, want request 2", pending)
+	}
+	if state, waiting := wh.State(); state != MotionIdle || waiting != 0 {
+		t.Errorf("%s with %d waiting after forgetting, want idle", state, waiting)
+	}
+
+	// the firmware still answers the forgotten step
+	wh.motionDone(wh.stepReqQueue, "step")
+	if state, _ := wh.State(); state != MotionIdle {
+		t.Errorf("%s after the forgotten step was answered, want idle", state)
+	}
+}
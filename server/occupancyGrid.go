@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// the grid covers GridSize by GridSize cells of GridResolution cm, with
+	// the origin in the middle
+	GridSize       = 400
+	GridResolution = 5.0
+
+	// SonarMaxRange is the furthest the firmware measures, in cm. It
+	// reports this range when there is no echo.
+	SonarMaxRange = 200
+	// SonarBeamWidth is the opening angle of the sonar cone in degrees
+	SonarBeamWidth = 30.0
+	// SonarRangeTolerance is how far either side of the measured range a
+	// cell counts as the obstacle, in cm
+	SonarRangeTolerance = 5.0
+
+	// log-odds added to a cell for each reading that sees it free or
+	// occupied, and the bound its belief is kept within
+	gridFree     = -0.4
+	gridOccupied = 0.85
+	gridLimit    = 5.0
+
+	// thresholds of the map_server YAML
+	gridOccupiedThresh = 0.65
+	gridFreeThresh     = 0.196
+)
+
+// OccupancyGrid is a probabilistic map of the rover's surroundings, built
+// from sonar readings taken at the rover's estimated pose. Each cell keeps
+// the log-odds of being occupied, zero meaning unknown. Cell coordinates
+// follow the pose: x to the right of the origin heading, y ahead of it.
+type OccupancyGrid struct {
+	mutex   sync.Mutex
+	logOdds []float64
+}
+
+// GridWindow is the block of cells that holds everything known, which is
+// what the map is served and exported as. X and Y are the lowest cell
+// indices.
+type GridWindow struct {
+	X, Y          int
+	Width, Height int
+}
+
+func NewOccupancyGrid() *OccupancyGrid {
+	return &OccupancyGrid{logOdds: make([]float64, GridSize*GridSize)}
+}
+
+func (g *OccupancyGrid) Clear() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for i := range g.logOdds {
+		g.logOdds[i] = 0
+	}
+}
+
+// AddReading updates the grid with a sonar reading of rangeCm taken with the
+// head at headAngle, in degrees to the right of the rover's heading. The
+// beam model sees the cells in the sonar cone short of the range as free
+// and the arc at the range as occupied, weighting both towards the axis of
+// the cone. A reading at the maximum range only clears cells.
+func (g *OccupancyGrid) AddReading(pose Pose, headAngle int, rangeCm int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	beam := pose.Heading + float64(headAngle)
+	reach := math.Min(float64(rangeCm)+SonarRangeTolerance, SonarMaxRange)
+	hit := rangeCm < SonarMaxRange
+
+	x0, y0 := g.cell(pose.X-reach, pose.Y-reach)
+	x1, y1 := g.cell(pose.X+reach, pose.Y+reach)
+	for cy := y0; cy <= y1; cy++ {
+		for cx := x0; cx <= x1; cx++ {
+			dx, dy := g.center(cx, cy)
+			dx, dy = dx-pose.X, dy-pose.Y
+			distance := math.Hypot(dx, dy)
+			if distance > reach {
+				continue
+			}
+			off := math.Abs(normalizeAngle(math.Atan2(dx, dy)*180/math.Pi - beam))
+			if off > SonarBeamWidth/2 {
+				continue
+			}
+			weight := 1 - math.Pow(off/(SonarBeamWidth/2), 2)
+
+			i := cy*GridSize + cx
+			if distance < float64(rangeCm)-SonarRangeTolerance {
+				g.logOdds[i] += gridFree * weight
+			} else if hit {
+				g.logOdds[i] += gridOccupied * weight
+			} else {
+				continue
+			}
+			g.logOdds[i] = math.Max(-gridLimit, math.Min(gridLimit, g.logOdds[i]))
+		}
+	}
+}
+
+// cell returns the indices of the cell holding x, y, clamped to the grid.
+func (g *OccupancyGrid) cell(x float64, y float64) (int, int) {
+	clamp := func(v float64) int {
+		i := int(math.Floor(v/GridResolution)) + GridSize/2
+		if i < 0 {
+			return 0
+		} else if i >= GridSize {
+			return GridSize - 1
+		}
+		return i
+	}
+	return clamp(x), clamp(y)
+}
+
+// center returns the position of the middle of a cell in cm.
+func (g *OccupancyGrid) center(cx int, cy int) (float64, float64) {
+	return (float64(cx-GridSize/2) + 0.5) * GridResolution, (float64(cy-GridSize/2) + 0.5) * GridResolution
+}
+
+// window returns the smallest block of cells holding every known cell, or
+// the cell at the origin if nothing is known yet. Must be called with
+// g.mutex held.
+func (g *OccupancyGrid) window() GridWindow {
+	x0, y0, x1, y1 := GridSize, GridSize, -1, -1
+	for i, l := range g.logOdds {
+		if l == 0 {
+			continue
+		}
+		cx, cy := i%GridSize, i/GridSize
+		if cx < x0 {
+			x0 = cx
+		}
+		if cx > x1 {
+			x1 = cx
+		}
+		if cy < y0 {
+			y0 = cy
+		}
+		if cy > y1 {
+			y1 = cy
+		}
+	}
+	if x1 < 0 {
+		return GridWindow{X: GridSize / 2, Y: GridSize / 2, Width: 1, Height: 1}
+	}
+	return GridWindow{X: x0, Y: y0, Width: x1 - x0 + 1, Height: y1 - y0 + 1}
+}
+
+// Origin returns the position in cm of the lower left corner of the window.
+func (gw GridWindow) Origin() (float64, float64) {
+	return float64(gw.X-GridSize/2) * GridResolution, float64(gw.Y-GridSize/2) * GridResolution
+}
+
+// Occupancy returns the window's cells row by row from its lowest row, as
+// percentages of occupancy with -1 for unknown cells.
+func (g *OccupancyGrid) Occupancy() (GridWindow, []int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	gw := g.window()
+	data := make([]int, 0, gw.Width*gw.Height)
+	for cy := gw.Y; cy < gw.Y+gw.Height; cy++ {
+		for cx := gw.X; cx < gw.X+gw.Width; cx++ {
+			l := g.logOdds[cy*GridSize+cx]
+			if l == 0 {
+				data = append(data, -1)
+			} else {
+				data = append(data, int(math.Floor(probability(l)*100+0.5)))
+			}
+		}
+	}
+	return gw, data
+}
+
+// Image renders the window with occupied cells black, free cells white and
+// unknown cells grey, ahead of the origin at the top.
+func (g *OccupancyGrid) Image() (GridWindow, *image.Gray) {
+	gw, data := g.Occupancy()
+	img := image.NewGray(image.Rect(0, 0, gw.Width, gw.Height))
+	for row := 0; row < gw.Height; row++ {
+		for col := 0; col < gw.Width; col++ {
+			img.SetGray(col, gw.Height-1-row, color.Gray{Y: grayLevel(data[row*gw.Width+col])})
+		}
+	}
+	return gw, img
+}
+
+func (g *OccupancyGrid) WritePNG(w io.Writer) error {
+	_, img := g.Image()
+	return png.Encode(w, img)
+}
+
+// WritePGM writes a map image as a binary PGM image in the style of the ROS
+// map_server, to go with the YAML from WriteMapYAML.
+func WritePGM(w io.Writer, img *image.Gray) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P5\n# sparky occupancy grid, %.0f cm per cell\n%d %d\n255\n", GridResolution, img.Rect.Dx(), img.Rect.Dy())
+	bw.Write(img.Pix)
+	return bw.Flush()
+}
+
+// WriteMapYAML writes the map_server description of the PGM image named
+// imageName, showing the cells of gw. map_server works in metres.
+func WriteMapYAML(w io.Writer, gw GridWindow, imageName string) error {
+	x, y := gw.Origin()
+	_, err := fmt.Fprintf(w, "image: %s\nresolution: %g\norigin: [%g, %g, 0.0]\nnegate: 0\noccupied_thresh: %g\nfree_thresh: %g\n",
+		imageName, GridResolution/100, x/100, y/100, gridOccupiedThresh, gridFreeThresh)
+	return err
+}
+
+func probability(logOdds float64) float64 {
+	return 1 - 1/(1+math.Exp(logOdds))
+}
+
+// grayLevel maps a cell occupancy percentage to the map_server convention,
+// where darker is more likely occupied and 205 is unknown.
+func grayLevel(occupancy int) uint8 {
+	if occupancy < 0 {
+		return 205
+	}
+	return uint8(255 - occupancy*255/100)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOccupancyGridAddReading(t *testing.T) {
+	g := NewOccupancyGrid()
+	// a wall 50 cm ahead of the origin
+	g.AddReading(Pose{}, 0, 50)
+
+	tests := []struct {
+		name  string
+		x, y  float64
+		check func(float64) bool
+	}{
+		{"short of the range", 0, 25, func(l float64) bool { return l < 0 }},
+		{"at the range", 0, 50, func(l float64) bool { return l > 0 }},
+		{"beyond the range", 0, 80, func(l float64) bool { return l == 0 }},
+		{"behind", 0, -25, func(l float64) bool { return l == 0 }},
+		{"outside the cone", 40, 25, func(l float64) bool { return l == 0 }},
+	}
+	for _, test := range tests {
+		cx, cy := g.cell(test.x, test.y)
+		if l := g.logOdds[cy*GridSize+cx]; !test.check(l) {
+			t.Errorf("%s: log-odds %v", test.name, l)
+		}
+	}
+}
+
+func TestOccupancyGridNoEcho(t *testing.T) {
+	g := NewOccupancyGrid()
+	g.AddReading(Pose{}, 0, SonarMaxRange)
+	for i, l := range g.logOdds {
+		if l > 0 {
+			t.Fatalf("cell %d marked occupied without an echo", i)
+		}
+	}
+}
+
+func TestOccupancyGridHeading(t *testing.T) {
+	g := NewOccupancyGrid()
+	// facing right with the head turned left still looks ahead
+	g.AddReading(Pose{Heading: 90}, -90, 50)
+	cx, cy := g.cell(0, 50)
+	if l := g.logOdds[cy*GridSize+cx]; l <= 0 {
+		t.Errorf("log-odds %v at the range ahead", l)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// PoseEventInterval is how often the pose is published while the rover moves
+const PoseEventInterval = 250 * time.Millisecond
+
+// Pose is where the rover is estimated to be relative to its origin. The axes
+// follow Scratch: x grows to the right of the origin heading and y ahead of
+// it, both in centimetres, and the heading is in degrees clockwise from the
+// origin heading, between -180 and 180.
+type Pose struct {
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Heading float64 `json:"heading"`
+}
+
+// Motion is a movement at constant speeds. Speed is in cm per second,
+// negative when backing up, and TurnRate in degrees per second clockwise.
+// A Duration of zero lasts until the next motion.
+type Motion struct {
+	Speed    float64
+	TurnRate float64
+	Duration time.Duration
+}
+
+// Odometry estimates the rover's pose by dead reckoning. There are no wheel
+// encoders, so the wheels report each motion as they command it and the pose
+// is integrated from the expected speeds and the time spent moving.
+type Odometry struct {
+	mutex sync.Mutex
+	// pose is where the rover was at start, when motion began or was last
+	// integrated
+	pose    Pose
+	motion  Motion
+	moving  bool
+	start   time.Time
+	events  *EventStream
+	monitor *Monitor
+}
+
+func NewOdometry(events *EventStream) *Odometry {
+	return &Odometry{events: events, monitor: NewMonitor()}
+}
+
+// Move starts a new motion, ending the one in progress.
+func (o *Odometry) Move(m Motion) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := time.Now()
+	o.advance(now)
+	o.motion, o.moving, o.start = m, true, now
+	o.publish()
+	o.monitor.Start(PoseEventInterval, o.publishMoving)
+}
+
+// Stop ends the motion in progress.
+func (o *Odometry) Stop() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.advance(time.Now())
+	if o.moving {
+		o.moving = false
+		o.publish()
+	}
+}
+
+// SetOrigin makes the current pose the origin. A motion in progress carries
+// on from there.
+func (o *Odometry) SetOrigin() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.advance(time.Now())
+	o.pose = Pose{}
+	fmt.Println("Odometry: origin set")
+	o.publish()
+}
+
+func (o *Odometry) Pose() Pose {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.advance(time.Now())
+	return o.pose
+}
+
+// Motion returns the motion in progress, if any.
+func (o *Odometry) Motion() (Motion, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.advance(time.Now())
+	return o.motion, o.moving
+}
+
+func (o *Odometry) Moving() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.advance(time.Now())
+	return o.moving
+}
+
+// WriteReporters writes the pose as poll lines.
+func (o *Odometry) WriteReporters(w io.Writer) {
+	pose := o.Pose()
+	fmt.Fprintf(w, "xPosition %.1f\n", pose.X)
+	fmt.Fprintf(w, "yPosition %.1f\n", pose.Y)
+	fmt.Fprintf(w, "heading %.1f\n", pose.Heading)
+}
+
+// publishMoving publishes the pose while the rover moves. The pose is
+// published once more when a timed motion runs out.
+func (o *Odometry) publishMoving() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	wasMoving := o.moving
+	o.advance(time.Now())
+	if wasMoving {
+		o.publish()
+	}
+	if !o.moving {
+		o.monitor.Stop()
+	}
+}
+
+// publish sends a pose event. Must be called with o.mutex held.
+func (o *Odometry) publish() {
+	o.events.Publish("pose", map[string]interface{}{
+		"x":       o.pose.X,
+		"y":       o.pose.Y,
+		"heading": o.pose.Heading,
+		"moving":  o.moving,
+	})
+}
+
+// advance integrates the motion in progress up to now. Must be called with
+// o.mutex held.
+func (o *Odometry) advance(now time.Time) {
+	if !o.moving {
+		return
+	}
+	elapsed := now.Sub(o.start)
+	if o.motion.Duration > 0 && elapsed >= o.motion.Duration {
+		elapsed = o.motion.Duration
+		o.moving = false
+	} else if o.motion.Duration > 0 {
+		o.motion.Duration -= elapsed
+	}
+	o.pose = o.pose.Integrate(o.motion.Speed, o.motion.TurnRate, elapsed)
+	o.start = now
+}
+
+// Integrate returns the pose reached by moving from p at constant speed and
+// turn rate for d. The rover follows a circular arc, or a straight line when
+// it does not turn.
+func (p Pose) Integrate(speed float64, turnRate float64, d time.Duration) Pose {
+	t := d.Seconds()
+	from := p.Heading * math.Pi / 180
+	if math.Abs(turnRate) < 1e-9 {
+		p.X += speed * t * math.Sin(from)
+		p.Y += speed * t * math.Cos(from)
+		return p
+	}
+	omega := turnRate * math.Pi / 180
+	to := from + omega*t
+	p.X += speed / omega * (math.Cos(from) - math.Cos(to))
+	p.Y += speed / omega * (math.Sin(to) - math.Sin(from))
+	p.Heading = normalizeAngle(p.Heading + turnRate*t)
+	return p
+}
+
+// normalizeAngle brings an angle in degrees between -180 and 180.
+func normalizeAngle(degrees float64) float64 {
+	degrees = math.Mod(degrees, 360)
+	if degrees > 180 {
+		degrees -= 360
+	} else if degrees <= -180 {
+		degrees += 360
+	}
+	return degrees
+}
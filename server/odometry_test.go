@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPoseIntegrate(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     Pose
+		speed    float64
+		turnRate float64
+		d        time.Duration
+		want     Pose
+	}{
+		{"ahead", Pose{}, 10, 0, 2 * time.Second, Pose{0, 20, 0}},
+		{"backward", Pose{}, -10, 0, time.Second, Pose{0, -10, 0}},
+		{"facing right", Pose{Heading: 90}, 10, 0, time.Second, Pose{10, 0, 90}},
+		{"turn on the spot", Pose{}, 0, 90, time.Second, Pose{0, 0, 90}},
+		// a quarter circle of radius 10 to the right
+		{"arc", Pose{}, 10 * math.Pi / 2, 90, time.Second, Pose{10, 10, 90}},
+		{"heading wraps", Pose{Heading: 170}, 0, 20, time.Second, Pose{0, 0, -170}},
+	}
+	for _, test := range tests {
+		got := test.from.Integrate(test.speed, test.turnRate, test.d)
+		if math.Abs(got.X-test.want.X) > 1e-6 || math.Abs(got.Y-test.want.Y) > 1e-6 || math.Abs(got.Heading-test.want.Heading) > 1e-6 {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DefaultProfile is the calibration profile of a robot until another one is
+// named on the command line or chosen from Scratch.
+const DefaultProfile = "default"
+
+// ProfileStore keeps named calibration profiles on disk, along with the
+// profile each robot uses. Robots are known by the port they are connected
+// on, as nothing the board reports tells them apart.
+type ProfileStore struct {
+	mutex    sync.Mutex
+	path     string
+	Profiles map[string]*Calibration `json:"profiles"`
+	Robots   map[string]string       `json:"robots"`
+}
+
+// DefaultProfilesPath returns the profile file in the user's configuration
+// directory.
+func DefaultProfilesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "sparky", "profiles.json")
+}
+
+// LoadProfiles reads the profiles stored at path. A missing file yields an
+// empty store that is created on the first save. Settings missing from a
+// stored profile keep their defaults, and a profile that is null or fails
+// validation is an error rather than a robot that cannot move.
+func LoadProfiles(path string) (*ProfileStore, error) {
+	ps := &ProfileStore{
+		path:     path,
+		Profiles: make(map[string]*Calibration),
+		Robots:   make(map[string]string),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	} else if err != nil {
+		return ps, fmt.Errorf("Could not read profiles %s err - %s", path, err)
+	}
+	var stored struct {
+		Profiles map[string]json.RawMessage `json:"profiles"`
+		Robots   map[string]string          `json:"robots"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return ps, fmt.Errorf("Could not parse profiles %s err - %s", path, err)
+	}
+	for name, raw := range stored.Profiles {
+		if string(raw) == "null" {
+			return ps, fmt.Errorf("Could not parse profiles %s err - profile %s is empty", path, name)
+		}
+		cal := DefaultCalibration()
+		if err := json.Unmarshal(raw, cal); err != nil {
+			return ps, fmt.Errorf("Could not parse profiles %s err - profile %s - %s", path, name, err)
+		}
+		if err := cal.Validate(); err != nil {
+			return ps, fmt.Errorf("Invalid profile %s in %s err - %s", name, path, err)
+		}
+		ps.Profiles[name] = cal
+	}
+	for robot, name := range stored.Robots {
+		ps.Robots[robot] = name
+	}
+	return ps, nil
+}
+
+// Get returns the named profile, creating it from the defaults if it does
+// not exist yet.
+func (ps *ProfileStore) Get(name string) *Calibration {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	return ps.profile(name)
+}
+
+// ForRobot returns the name and calibration of the profile the robot uses,
+// the default profile for a robot not seen before.
+func (ps *ProfileStore) ForRobot(robot string) (string, *Calibration) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	name, ok := ps.Robots[robot]
+	if !ok {
+		name = DefaultProfile
+	}
+	return name, ps.profile(name)
+}
+
+// Use makes the robot use the named profile, creating it from the defaults
+// if it does not exist yet.
+func (ps *ProfileStore) Use(robot string, name string) *Calibration {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.Robots[robot] = name
+	return ps.profile(name)
+}
+
+// Names returns the names of all stored profiles in order.
+func (ps *ProfileStore) Names() []string {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	names := make([]string, 0, len(ps.Profiles))
+	for name := range ps.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ps *ProfileStore) profile(name string) *Calibration {
+	cal, ok := ps.Profiles[name]
+	if !ok {
+		cal = DefaultCalibration()
+		ps.Profiles[name] = cal
+	}
+	return cal
+}
+
+// Save writes the store to disk, replacing the previous file only once the
+// new one is complete.
+func (ps *ProfileStore) Save() error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	data, err := json.MarshalIndent(ps, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ps.path), 0755); err != nil {
+		return fmt.Errorf("Could not save profiles %s err - %s", ps.path, err)
+	}
+	tmp := ps.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Could not save profiles %s err - %s", ps.path, err)
+	}
+	if err := os.Rename(tmp, ps.path); err != nil {
+		return fmt.Errorf("Could not save profiles %s err - %s", ps.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfileStoreSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	ps, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Use("/dev/ttyUSB0", "table").Set("cmPerStep", 1.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Get("table").CmPerStep; got != 1.5 {
+		t.Errorf("cmPerStep %v after loading, want 1.5", got)
+	}
+	if name, cal := loaded.ForRobot("/dev/ttyUSB0"); name != "table" || cal.CmPerStep != 1.5 {
+		t.Errorf("robot uses profile %s with cmPerStep %v after loading, want table", name, cal.CmPerStep)
+	}
+	// a robot not seen before gets the defaults
+	if name, cal := loaded.ForRobot("/dev/ttyUSB1"); name != DefaultProfile || *cal != *DefaultCalibration() {
+		t.Errorf("new robot uses profile %s %+v, want the defaults", name, cal)
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored string
+		ok     bool
+	}{
+		{"partial", `{"profiles": {"table": {"cmPerStep": 1.5}}}`, true},
+		{"null", `{"profiles": {"table": null}}`, false},
+		{"zero rate", `{"profiles": {"table": {"leftDegreesPerMilli": 0}}}`, false},
+		{"wrong type", `{"profiles": {"table": {"cmPerStep": "fast"}}}`, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "profiles.json")
+		if err := ioutil.WriteFile(path, []byte(test.stored), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ps, err := LoadProfiles(path)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err %v, want ok %t", test.name, err, test.ok)
+		}
+		if err != nil {
+			continue
+		}
+		// settings missing from the file keep their defaults
+		want := *DefaultCalibration()
+		want.CmPerStep = 1.5
+		if got := ps.Get("table"); *got != want {
+			t.Errorf("%s: loaded %+v, want %+v", test.name, got, want)
+		}
+	}
+}
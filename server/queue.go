@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RequestTimeoutMargin is added to the expected duration of every command
+// to allow for serial latency before a request is considered lost.
+const RequestTimeoutMargin = 2 * time.Second
+
+// StaleGrace is how long an expired request keeps its place in the queue,
+// so that a reply arriving late is discarded rather than taken for the
+// reply to the next request. A reply later than that is lost for good.
+const StaleGrace = 5 * time.Second
+
+type queuedReq struct {
+	work     Work
+	deadline time.Time
+	// stale requests were issued before a reset. Their replies may still
+	// arrive and are swallowed instead of being matched to newer requests.
+	stale bool
+}
+
+// RequestQueue holds the requests a device has sent to the board and is
+// still waiting on, in the order the board answers them. Unlike a channel,
+// requests can be dropped from it once their deadline has passed.
+type RequestQueue struct {
+	mutex sync.Mutex
+	reqs  []queuedReq
+}
+
+func NewRequestQueue() *RequestQueue {
+	return &RequestQueue{}
+}
+
+// Push queues w, expecting the board to answer within duration plus
+// RequestTimeoutMargin.
+func (q *RequestQueue) Push(w Work, duration time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.reqs = append(q.reqs, queuedReq{work: w, deadline: time.Now().Add(duration + RequestTimeoutMargin)})
+}
+
+// Remove drops the most recently queued request with the ID and type of w.
+// It is used when sending the command to the board failed after queuing it.
+func (q *RequestQueue) Remove(w Work) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i := len(q.reqs) - 1; i >= 0; i-- {
+		if q.reqs[i].work.GetID() == w.GetID() && q.reqs[i].work.GetType() == w.GetType() {
+			q.reqs = append(q.reqs[:i], q.reqs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pop removes the oldest request. ok is false when nothing is waiting, or
+// when the reply belongs to a request that expired or was issued before the
+// last Flush.
+func (q *RequestQueue) Pop() (w Work, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.reqs) == 0 {
+		return nil, false
+	}
+	req := q.reqs[0]
+	q.reqs = q.reqs[1:]
+	if req.stale {
+		return nil, false
+	}
+	return req.work, true
+}
+
+// Flush marks every queued request as stale and returns the ones that were
+// not yet. Stale requests are never reported, but keep their place in the
+// queue until they are answered or expire so that late replies are not
+// attributed to newer requests.
+func (q *RequestQueue) Flush() (flushed []Work) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i := range q.reqs {
+		if !q.reqs[i].stale {
+			flushed = append(flushed, q.reqs[i].work)
+		}
+		q.reqs[i].stale = true
+	}
+	return
+}
+
+// Len returns the number of requests still waiting, stale ones included.
+func (q *RequestQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.reqs)
+}
+
+// Expire returns the requests whose deadline is before now and marks them
+// stale. They stay in the queue for StaleGrace in case the board answers
+// late. Stale requests past their deadline are removed.
+func (q *RequestQueue) Expire(now time.Time) (expired []Work) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	kept := q.reqs[:0]
+	for _, req := range q.reqs {
+		switch {
+		case !req.deadline.Before(now):
+			kept = append(kept, req)
+		case !req.stale:
+			expired = append(expired, req.work)
+			req.stale, req.deadline = true, now.Add(StaleGrace)
+			kept = append(kept, req)
+		}
+	}
+	q.reqs = kept
+	return
+}
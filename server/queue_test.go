@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestQueueExpireKeepsPlace(t *testing.T) {
+	q := NewRequestQueue()
+	first := SonarReq{ID: "1", reqType: SonarRangeReq}
+	second := SonarReq{ID: "2", reqType: SonarRangeReq}
+	q.Push(first, 0)
+	now := time.Now().Add(RequestTimeoutMargin + time.Second)
+
+	expired := q.Expire(now)
+	if len(expired) != 1 || expired[0].GetID() != "1" {
+		t.Fatalf("expired %v, want request 1", expired)
+	}
+	if again := q.Expire(now); len(again) != 0 {
+		t.Fatalf("expired %v again", again)
+	}
+	q.Push(second, time.Minute)
+
+	// the late reply to the first request is swallowed
+	if w, ok := q.Pop(); ok {
+		t.Fatalf("late reply matched %v", w)
+	}
+	if w, ok := q.Pop(); !ok || w.GetID() != "2" {
+		t.Fatalf("reply matched %v %t, want request 2", w, ok)
+	}
+}
+
+func TestRequestQueueExpireDropsAfterGrace(t *testing.T) {
+	q := NewRequestQueue()
+	q.Push(SonarReq{ID: "1"}, 0)
+	now := time.Now().Add(RequestTimeoutMargin + time.Second)
+	q.Expire(now)
+	if q.Len() != 1 {
+		t.Fatalf("len %d after expiring, want 1", q.Len())
+	}
+
+	if expired := q.Expire(now.Add(StaleGrace + time.Second)); len(expired) != 0 {
+		t.Fatalf("stale request reported again: %v", expired)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("len %d after grace, want 0", q.Len())
+	}
+}
+
+func TestRequestQueue(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(q *RequestQueue)
+		pops  []string // ID matched by each reply, "" for a discarded one
+	}{
+		{"in order", func(q *RequestQueue) {
+			q.Push(SonarReq{ID: "1"}, time.Minute)
+			q.Push(SonarReq{ID: "2"}, time.Minute)
+		}, []string{"1", "2"}},
+		{"flushed", func(q *RequestQueue) {
+			q.Push(SonarReq{ID: "1"}, time.Minute)
+			q.Flush()
+			q.Push(SonarReq{ID: "2"}, time.Minute)
+		}, []string{"", "2"}},
+		{"removed", func(q *RequestQueue) {
+			q.Push(SonarReq{ID: "1"}, time.Minute)
+			q.Push(SonarReq{ID: "2"}, time.Minute)
+			q.Remove(SonarReq{ID: "1"})
+		}, []string{"2", ""}},
+	}
+	for _, tt := range tests {
+		q := NewRequestQueue()
+		tt.setup(q)
+		for i, want := range tt.pops {
+			w, ok := q.Pop()
+			got := ""
+			if ok {
+				got = w.GetID()
+			}
+			if got != want {
+				t.Errorf("%s: reply %d matched %q, want %q", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestRequestQueueFlushReturnsLive(t *testing.T) {
+	q := NewRequestQueue()
+	q.Push(SonarReq{ID: "1"}, time.Minute)
+	q.Flush()
+	q.Push(SonarReq{ID: "2"}, time.Minute)
+	if flushed := q.Flush(); len(flushed) != 1 || flushed[0].GetID() != "2" {
+		t.Fatalf("flushed %v, want request 2", flushed)
+	}
+}
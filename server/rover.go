@@ -4,24 +4,25 @@ import (
 	"fmt"
 	"github.com/sparkybots/goserial"
 	"github.com/sparkybots/sparky/server/board"
-	"os"
+	"math"
 	"strconv"
 	"time"
 )
 
 type Rover struct {
-	board      *board.Board
-	sonar      Sonar
-	buzzer     Buzzer
-	wheels     Wheels
-	lineSensor LineSensor
+	board       *board.Board
+	calibration *Calibration
+	sonar       *Sonar
+	buzzer      *Buzzer
+	wheels      *Wheels
+	lineSensor  *LineSensor
 }
 
 func (r *Rover) Connected() bool {
 	return r.board != nil
 }
 
-func (r *Rover) Setup(comPort string, respQ chan Work) error {
+func (r *Rover) Setup(comPort string, respQ chan Work, cal *Calibration, odometry *Odometry) error {
 
 	fmt.Println("Connecting to board ...")
 
@@ -32,16 +33,18 @@ func (r *Rover) Setup(comPort string, respQ chan Work) error {
 		if err := r.board.Connect(p); err != nil {
 			r.board = nil
 			fmt.Println("Could not initialize firmata err - ", err)
-			return fmt.Errorf("Could not initialize firmata err - ", err)
+			return fmt.Errorf("Could not initialize firmata err - %s", err)
 		} else {
 			fmt.Println("Connected and initialized firmata")
 			fmt.Println("firmware name:", r.board.FirmwareName)
 			fmt.Println("firmata version:", r.board.ProtocolVersion)
 
-			r.sonar = CreateSonar(r.board, respQ)
+			r.calibration = cal
+			r.sonar = CreateSonar(r.board, respQ, cal)
 			r.buzzer = CreateBuzzer(r.board, respQ)
-			r.wheels = CreateWheels(r.board, respQ)
-			r.lineSensor = CreateLineSensor(r.board, respQ)
+			r.wheels = CreateWheels(r.board, respQ, cal, odometry)
+			r.lineSensor = CreateLineSensor(r.board, respQ, cal)
+			r.wheels.ApplyTrim()
 
 			r.Light("red")
 			time.Sleep(time.Millisecond * 80)
@@ -57,26 +60,107 @@ func (r *Rover) Setup(comPort string, respQ chan Work) error {
 
 	} else {
 		fmt.Println("Could not connect to board at ", comPort, err)
-		return fmt.Errorf("Could not connect to board at ", comPort, err)
+		return fmt.Errorf("Could not connect to board at %s err - %s", comPort, err)
 	}
 
 	return nil
 }
 
-func (r *Rover) heartBeat() {
+// SetCalibration switches the rover to another calibration profile.
+func (r *Rover) SetCalibration(cal *Calibration) error {
+	r.calibration = cal
+	r.sonar.calibration = cal
+	r.wheels.calibration = cal
+	r.lineSensor.calibration = cal
+	return r.wheels.ApplyTrim()
+}
+
+// heartBeat checks the serial link, releasing the board when it is gone so
+// that the rover can be set up again.
+func (r *Rover) heartBeat() error {
 	if err := r.board.RoverHeartBeat(); err != nil {
-		fmt.Println("Board is disconnected - err %s", err)
-		if err := r.board.Disconnect(); err != nil {
-			fmt.Println("Could not release board - err ", err)
-		}
-		os.Exit(1)
+		fmt.Println("Board is disconnected - err ", err)
+		r.Disconnect()
+		return err
+	}
+	return nil
+}
+
+// ExpireRequests drops the requests the board has not answered in time from
+// every device queue and returns them.
+func (r *Rover) ExpireRequests(now time.Time) (expired []Work) {
+	expired = append(expired, r.sonar.ExpireRequests(now)...)
+	expired = append(expired, r.buzzer.ExpireRequests(now)...)
+	expired = append(expired, r.wheels.ExpireRequests(now)...)
+	expired = append(expired, r.lineSensor.ExpireRequests(now)...)
+	return
+}
+
+// Monitor starts or stops the background readings of sensor, one of
+// SonarSensor or LineSensors.
+func (r *Rover) Monitor(sensor string, on bool) {
+	if !r.Connected() {
 		return
 	}
+	switch {
+	case sensor == SonarSensor && on:
+		r.sonar.StartMonitor()
+	case sensor == SonarSensor:
+		r.sonar.StopMonitor()
+	case sensor == LineSensors && on:
+		r.lineSensor.StartMonitor()
+	case sensor == LineSensors:
+		r.lineSensor.StopMonitor()
+	case sensor == LineStream:
+		if err := r.lineSensor.Stream(on); err != nil {
+			fmt.Println(err)
+		}
+	}
 }
 
+func (r *Rover) Disconnect() {
+	r.sonar.StopMonitor()
+	r.lineSensor.StopMonitor()
+	r.wheels.StopRamp()
+	// nothing more is known about where the rover goes
+	r.wheels.odometry.Stop()
+	if err := r.board.Disconnect(); err != nil {
+		fmt.Println("Could not release board - err ", err)
+	}
+	r.board = nil
+}
+
+// Reset stops the motors and the buzzer, resets the board and forgets about
+// every request still in flight. Replies to those requests are discarded.
 func (r *Rover) Reset(vars map[string]string) error {
 	fmt.Println("Rover - Reset")
-	return r.board.Reset()
+
+	r.sonar.FlushRequests()
+	r.buzzer.FlushRequests()
+	r.wheels.FlushRequests()
+	r.lineSensor.FlushRequests()
+
+	if err := r.wheels.EmergencyStop(); err != nil {
+		return err
+	}
+	if err := r.buzzer.BuzzerOff(); err != nil {
+		return err
+	}
+	if err := r.board.Reset(); err != nil {
+		return err
+	}
+	r.lineSensor.StreamReset()
+	return r.wheels.ApplyTrim()
+}
+
+func (r *Rover) SetTrim(vars map[string]string) error {
+	left, _ := strconv.ParseFloat(vars["left"], 64)
+	right, _ := strconv.ParseFloat(vars["right"], 64)
+
+	fmt.Println("Rover - SetTrim ", left, right)
+	r.calibration.LeftTrim = left
+	r.calibration.RightTrim = right
+	return r.wheels.ApplyTrim()
 }
 
 func (r *Rover) ReadSonar(vars map[string]string) error {
@@ -106,7 +190,57 @@ func (r *Rover) Run(vars map[string]string) error {
 	dir := vars["dir"]
 
 	fmt.Println("Rover - Run ", dir)
-	return r.wheels.Run(dir, 0, 0)
+	return r.wheels.RunDefault(dir)
+}
+
+// parseSpeed reads a speed percentage from a block, which Scratch may send
+// with a fraction, as the nearest whole speed no faster than full speed
+// either way.
+func parseSpeed(value string) (int, error) {
+	speed, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(speed) {
+		return 0, fmt.Errorf("Invalid speed %s", value)
+	}
+	return int(math.Round(math.Max(-100, math.Min(100, speed)))), nil
+}
+
+func (r *Rover) RunSpeed(vars map[string]string) error {
+	dir := vars["dir"]
+	speed, err := parseSpeed(vars["speed"])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Rover - RunSpeed ", dir, speed)
+	return r.wheels.Run(dir, speed, speed)
+}
+
+func (r *Rover) Drive(vars map[string]string) error {
+	left, err := parseSpeed(vars["left"])
+	if err != nil {
+		return err
+	}
+	right, err := parseSpeed(vars["right"])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Rover - Drive ", left, right)
+	return r.wheels.Drive(left, right)
+}
+
+func (r *Rover) Curve(vars map[string]string) error {
+	linear, err := parseSpeed(vars["linear"])
+	if err != nil {
+		return err
+	}
+	angular, err := parseSpeed(vars["angular"])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Rover - Curve ", linear, angular)
+	return r.wheels.Curve(linear, angular)
 }
 
 func (r *Rover) Stop(vars map[string]string) error {
@@ -114,27 +248,27 @@ func (r *Rover) Stop(vars map[string]string) error {
 	return r.wheels.Stop()
 }
 
-var MillisPerDegreeTurn int = 6
-
 func (r *Rover) TurnCalibrate(vars map[string]string) error {
 	id := vars["id"]
 	dir := vars["dir"]
 	angle, _ := strconv.Atoi(vars["angle"])
 	steps, _ := strconv.Atoi(vars["steps"])
 
-	MillisPerDegreeTurn = steps
+	r.calibration.SetMillisPerDegree(dir, steps)
 
 	fmt.Println("Rover - TurnCalibrate ", id, dir, angle, steps)
-	return r.wheels.Turn(id, dir, angle, steps)
+	return r.wheels.Turn(id, dir, TurnPivot, angle, steps)
 }
 
+// Turn turns by angle degrees in mode, pivot if none is given.
 func (r *Rover) Turn(vars map[string]string) error {
 	id := vars["id"]
 	dir := vars["dir"]
-	angle, _ := strconv.Atoi(vars["angle"])
+	angle, _ := strconv.ParseFloat(vars["angle"], 64)
+	mode := vars["mode"]
 
-	fmt.Println("Rover - TurnCalibrate ", id, dir, angle)
-	return r.wheels.Turn(id, dir, angle, MillisPerDegreeTurn)
+	fmt.Println("Rover - Turn ", id, dir, angle, mode)
+	return r.wheels.TurnAngle(id, dir, mode, angle)
 }
 
 func (r *Rover) ReverseTurn(vars map[string]string) error {
@@ -142,8 +276,35 @@ func (r *Rover) ReverseTurn(vars map[string]string) error {
 	dir := vars["dir"]
 	angle, _ := strconv.Atoi(vars["angle"])
 
-	fmt.Println("Rover - TurnCalibrate ", id, dir, angle)
-	return r.wheels.ReverseTurn(id, dir, angle, MillisPerDegreeTurn)
+	fmt.Println("Rover - ReverseTurn ", id, dir, angle)
+	return r.wheels.ReverseTurn(id, dir, angle, r.calibration.MillisPerDegree(dir))
+}
+
+func (r *Rover) DriveDistance(vars map[string]string) error {
+	id := vars["id"]
+	dir := vars["dir"]
+	cm, _ := strconv.ParseFloat(vars["cm"], 64)
+
+	fmt.Println("Rover - DriveDistance ", id, dir, cm)
+	return r.wheels.DriveDistance(id, dir, cm)
+}
+
+func (r *Rover) DriveFor(vars map[string]string) error {
+	id := vars["id"]
+	dir := vars["dir"]
+	seconds, _ := strconv.ParseFloat(vars["seconds"], 64)
+
+	fmt.Println("Rover - DriveFor ", id, dir, seconds)
+	return r.wheels.DriveFor(id, dir, seconds)
+}
+
+func (r *Rover) TurnAngle(vars map[string]string) error {
+	id := vars["id"]
+	dir := vars["dir"]
+	degrees, _ := strconv.ParseFloat(vars["degrees"], 64)
+
+	fmt.Println("Rover - TurnAngle ", id, dir, degrees)
+	return r.wheels.TurnAngle(id, dir, TurnPivot, degrees)
 }
 
 func (r *Rover) Step(vars map[string]string) error {
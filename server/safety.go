@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// zones ahead of the rover, by the sonar range
+	SafetyClear = "clear"
+	SafetySlow  = "slow"
+	SafetyStop  = "stop"
+
+	// SafetyHeadAngle is how far the sonar head may be turned, in degrees,
+	// for its readings to count as the range ahead
+	SafetyHeadAngle = 15
+)
+
+// SafetySettings set the zones ahead of the rover in which the obstacle
+// protection slows it down or stops it.
+type SafetySettings struct {
+	// StopRange is the range, in cm, below which the rover is stopped when
+	// it moves forward
+	StopRange int `json:"stopRange"`
+	// SlowRange is the range, in cm, below which the rover is slowed down
+	SlowRange int `json:"slowRange"`
+	// MinSpeed is the part of the requested speed left at the stop range.
+	// The speed grows back linearly up to the slow range.
+	MinSpeed float64 `json:"minSpeed"`
+}
+
+func DefaultSafetySettings() SafetySettings {
+	return SafetySettings{
+		StopRange: 15,
+		SlowRange: 40,
+		MinSpeed:  0.3,
+	}
+}
+
+// Set changes the setting with the given JSON name.
+func (ss *SafetySettings) Set(field string, value float64) error {
+	switch field {
+	case "stopRange":
+		ss.StopRange = int(value)
+	case "slowRange":
+		ss.SlowRange = int(value)
+	case "minSpeed":
+		if value < 0 || value > 1 {
+			return fmt.Errorf("Invalid minimum speed %v, it is a part of the speed from 0 to 1", value)
+		}
+		ss.MinSpeed = value
+	default:
+		return fmt.Errorf("Unknown obstacle protection setting %s", field)
+	}
+	return nil
+}
+
+// Zone returns the zone a sonar range in cm falls in, and the part of the
+// requested speed the rover may keep there.
+func (ss SafetySettings) Zone(rangeCm int) (zone string, limit float64) {
+	switch {
+	case rangeCm < ss.StopRange:
+		return SafetyStop, ss.MinSpeed
+	case rangeCm < ss.SlowRange:
+		return SafetySlow, ss.MinSpeed + (1-ss.MinSpeed)*float64(rangeCm-ss.StopRange)/float64(ss.SlowRange-ss.StopRange)
+	}
+	return SafetyClear, 1
+}
+
+// drivesAhead tells whether motion takes the rover towards what is ahead,
+// with both wheels turning forward. A pivot turn, with its inner wheel
+// stopped, only swings the rover round.
+func drivesAhead(motion Motion, wheelBase float64) bool {
+	inner := motion.Speed - math.Abs(motion.TurnRate)*math.Pi/180*wheelBase/2
+	// allow for rounding in a pivot turn
+	return motion.Speed > 0 && inner > motion.Speed*1e-6
+}
+
+// checkSafety slows the rover down or stops it by the last sonar range, as
+// the obstacle protection is set. Only driving ahead is stopped, so that
+// the rover can still back away or turn. Readings taken with the sonar head
+// turned aside are not the range ahead and are ignored. Must be called with
+// s.mu held.
+func (s *Server) checkSafety() {
+	if !s.safetyOn || !s.rover.Connected() || abs(s.sensors.SonarAngle()) > SafetyHeadAngle {
+		return
+	}
+
+	rangeCm := s.sensors.SonarRange()
+	zone, limit := s.safety.Zone(rangeCm)
+	if zone != s.safetyZone {
+		s.safetyZone = zone
+		fmt.Println("Obstacle protection: ", zone, " at ", rangeCm, " cm")
+		s.events.Publish("safety", map[string]interface{}{
+			"zone":  zone,
+			"range": rangeCm,
+		})
+	}
+	if err := s.rover.wheels.SetSpeedLimit(limit); err != nil {
+		fmt.Println("Could not limit speed - err ", err)
+	}
+
+	if motion, moving := s.odometry.Motion(); zone == SafetyStop && moving && drivesAhead(motion, s.rover.calibration.WheelBase()) {
+		s.abortMotion("Obstacle ahead")
+		s.obstacleStop = true
+		s.events.Publish("obstacleStop", s.odometry.Pose())
+	}
+}
+
+// setSafety turns the obstacle protection on or off. Must be called with
+// s.mu held.
+func (s *Server) setSafety(on bool) {
+	s.safetyOn, s.safetyZone, s.obstacleStop = on, SafetyClear, false
+	fmt.Println("Obstacle protection ", on)
+	if s.rover.Connected() {
+		if err := s.rover.wheels.SetSpeedLimit(1); err != nil {
+			fmt.Println("Could not limit speed - err ", err)
+		}
+	}
+	s.updateMonitors()
+	s.checkSafety()
+}
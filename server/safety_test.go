@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/sparkybots/sparky/server/board"
+	"testing"
+)
+
+func TestSafetyZone(t *testing.T) {
+	ss := DefaultSafetySettings()
+	tests := []struct {
+		rangeCm int
+		zone    string
+		limit   float64
+	}{
+		{0, SafetyStop, 0.3},
+		{14, SafetyStop, 0.3},
+		{15, SafetySlow, 0.3},
+		{40, SafetyClear, 1},
+		{MAX_DISTANCE, SafetyClear, 1},
+	}
+	for _, test := range tests {
+		zone, limit := ss.Zone(test.rangeCm)
+		if zone != test.zone || limit != test.limit {
+			t.Errorf("Zone(%d) = %s %v, want %s %v", test.rangeCm, zone, limit, test.zone, test.limit)
+		}
+	}
+	if _, limit := ss.Zone(27); limit <= 0.3 || limit >= 1 {
+		t.Errorf("Zone(27) limit %v, want between 0.3 and 1", limit)
+	}
+}
+
+func TestDrivesAhead(t *testing.T) {
+	wh := &Wheels{calibration: DefaultCalibration()}
+	wheelBase := wh.calibration.WheelBase()
+	tests := []struct {
+		name   string
+		motion Motion
+		want   bool
+	}{
+		{"forward", wh.wheelMotion(DefaultPWM, DefaultPWM, 0), true},
+		{"arc", wh.wheelMotion(DefaultPWM, DefaultPWM/2, 0), true},
+		{"backward", wh.wheelMotion(-DefaultPWM, -DefaultPWM, 0), false},
+		{"one wheel", wh.wheelMotion(DefaultPWM, 0, 0), false},
+		{"pivot turn", wh.turnMotion("right", board.MoveDirFwd, TurnPivot, 100), false},
+		{"spin turn", wh.turnMotion("left", board.MoveDirFwd, TurnSpin, 100), false},
+		{"stopped", Motion{}, false},
+	}
+	for _, test := range tests {
+		if got := drivesAhead(test.motion, wheelBase); got != test.want {
+			t.Errorf("%s: drivesAhead(%+v) = %t, want %t", test.name, test.motion, got, test.want)
+		}
+	}
+}
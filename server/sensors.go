@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SensorState keeps the last known value of every Scratch reporter, so that
+// each poll can report all of them and not only the readings that arrived
+// since the previous poll.
+type SensorState struct {
+	mutex      sync.Mutex
+	connected  bool
+	sonarRange int
+	// sonarAngle is the head position in degrees, positive to the right
+	sonarAngle int
+	lineLeft   int
+	lineRight  int
+	// analog line sensor readings, -1 until there is one
+	lineLeftRaw  int
+	lineRightRaw int
+	sonarTime    time.Time
+	lineTime     time.Time
+	// lineEdges counts the LineEdges seen by Key
+	lineEdges map[string]int
+	// lineCrossings counts the lines found, from neither sensor seeing a
+	// line to either one seeing it
+	lineCrossings int
+}
+
+// LineEdge is a line sensor seeing a line appear, Entered, or disappear.
+type LineEdge struct {
+	Sensor    string `json:"sensor"`
+	Entered   bool   `json:"entered"`
+	Crossings int    `json:"crossings"`
+}
+
+// Key names the kind of edge, such as "left/entered".
+func (e LineEdge) Key() string {
+	if e.Entered {
+		return e.Sensor + "/entered"
+	}
+	return e.Sensor + "/left"
+}
+
+func NewSensorState() *SensorState {
+	return &SensorState{
+		sonarRange:   MAX_DISTANCE,
+		lineLeftRaw:  -1,
+		lineRightRaw: -1,
+		lineEdges:    make(map[string]int),
+	}
+}
+
+func (st *SensorState) SetConnected(connected bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.connected = connected
+}
+
+// Update records the value carried by a device response. It returns the
+// edge when a line sensor reading differs from the one before.
+func (st *SensorState) Update(resp Work) (edge *LineEdge) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	value, err := strconv.Atoi(resp.GetRespValue())
+	if err != nil {
+		return nil
+	}
+
+	switch resp.GetType() {
+	case SonarRangeReq:
+		st.sonarRange = value
+		st.sonarTime = time.Now()
+	case SonarTurnReq:
+		st.sonarAngle = value
+	case LineLeftResp:
+		edge = st.updateLine(&st.lineLeft, "left", value)
+		st.updateRaw(&st.lineLeftRaw, resp)
+		st.lineTime = time.Now()
+	case LineRightResp:
+		edge = st.updateLine(&st.lineRight, "right", value)
+		st.updateRaw(&st.lineRightRaw, resp)
+		st.lineTime = time.Now()
+	}
+	return edge
+}
+
+// updateLine sets the reading of one line sensor and counts its edge. Must
+// be called with st.mutex held.
+func (st *SensorState) updateLine(reading *int, sensor string, value int) *LineEdge {
+	if *reading == value {
+		return nil
+	}
+	if value == 1 && st.lineLeft == 0 && st.lineRight == 0 {
+		st.lineCrossings++
+	}
+	*reading = value
+
+	edge := &LineEdge{Sensor: sensor, Entered: value == 1, Crossings: st.lineCrossings}
+	st.lineEdges[edge.Key()]++
+	return edge
+}
+
+// updateRaw records the analog reading a line sensor response carries, if
+// any. Must be called with st.mutex held.
+func (st *SensorState) updateRaw(raw *int, resp Work) {
+	if req, ok := resp.(LineSensorReq); ok && req.Raw >= 0 {
+		*raw = req.Raw
+	}
+}
+
+// LinesRaw returns the last analog readings of the line sensors.
+func (st *SensorState) LinesRaw() (left int, right int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.lineLeftRaw, st.lineRightRaw
+}
+
+// LineEdges returns how many edges of a kind, named as by LineEdge.Key,
+// were seen.
+func (st *SensorState) LineEdges(key string) int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.lineEdges[key]
+}
+
+func (st *SensorState) LineCrossings() int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.lineCrossings
+}
+
+func (st *SensorState) ResetLineCrossings() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.lineCrossings = 0
+}
+
+func (st *SensorState) SonarRange() int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.sonarRange
+}
+
+func (st *SensorState) SonarAngle() int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.sonarAngle
+}
+
+func (st *SensorState) Lines() (left int, right int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.lineLeft, st.lineRight
+}
+
+// WriteReporters writes one "name value" poll line per reporter. The age
+// reporters give the seconds since the last reading, or -1 if there was none.
+func (st *SensorState) WriteReporters(w io.Writer) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	fmt.Fprintf(w, "connected %t\n", st.connected)
+	fmt.Fprintf(w, "sonarRange %d\n", st.sonarRange)
+	fmt.Fprintf(w, "sonarAngle %d\n", st.sonarAngle)
+	fmt.Fprintf(w, "sonarAge %s\n", age(st.sonarTime))
+	fmt.Fprintf(w, "lineLeft %d\n", st.lineLeft)
+	fmt.Fprintf(w, "lineRight %d\n", st.lineRight)
+	fmt.Fprintf(w, "lineLeftRaw %d\n", st.lineLeftRaw)
+	fmt.Fprintf(w, "lineRightRaw %d\n", st.lineRightRaw)
+	fmt.Fprintf(w, "lineAge %s\n", age(st.lineTime))
+	fmt.Fprintf(w, "lineCrossings %d\n", st.lineCrossings)
+}
+
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "-1"
+	}
+	return strconv.FormatFloat(time.Since(t).Seconds(), 'f', 1, 64)
+}
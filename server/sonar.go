@@ -5,19 +5,32 @@ import (
 	"github.com/sparkybots/gobot"
 	"github.com/sparkybots/sparky/server/board"
 	"strconv"
+	"time"
 )
 
 const (
 	MAX_DISTANCE  int    = 9999
 	SonarRangeReq string = "RANGE"
-	SonarTurnReq  string = "TURN"
+	SonarTurnReq  string = "SONAR_TURN"
+
+	// SonarReadTime covers the three pings the firmware averages
+	SonarReadTime = 500 * time.Millisecond
+	// SonarTurnTime is how long the firmware gives the head servo to settle
+	SonarTurnTime = 800 * time.Millisecond
+	// SonarMonitorInterval is how often the range is read in the background
+	SonarMonitorInterval = 200 * time.Millisecond
+	// SonarMaxAngle is the furthest the firmware turns the head either way
+	// from its own centre. Larger angles wrap around.
+	SonarMaxAngle = 90
 )
 
 type Sonar struct {
 	board         *board.Board
-	rangeReqQueue chan SonarReq
-	turnReqQueue  chan SonarReq
+	rangeReqQueue *RequestQueue
+	turnReqQueue  *RequestQueue
 	respQueue     chan Work
+	monitor       *Monitor
+	calibration   *Calibration
 }
 
 // SonaReq implements the Work interface
@@ -39,13 +52,15 @@ func (r SonarReq) GetRespValue() string {
 	return strconv.Itoa(r.Result)
 }
 
-func CreateSonar(b *board.Board, respQ chan Work) Sonar {
+func CreateSonar(b *board.Board, respQ chan Work, cal *Calibration) *Sonar {
 
-	sonar := Sonar{
+	sonar := &Sonar{
 		board:         b,
-		rangeReqQueue: make(chan SonarReq, 100),
-		turnReqQueue:  make(chan SonarReq, 100),
+		rangeReqQueue: NewRequestQueue(),
+		turnReqQueue:  NewRequestQueue(),
 		respQueue:     respQ,
+		monitor:       NewMonitor(),
+		calibration:   cal,
 	}
 
 	gobot.On(b.Event("SonarResponse"), sonar.processRangeResponse)
@@ -55,48 +70,104 @@ func CreateSonar(b *board.Board, respQ chan Work) Sonar {
 
 func (s *Sonar) ReadRange(id string) error {
 	req := SonarReq{ID: id, reqType: SonarRangeReq, Result: MAX_DISTANCE}
+	s.rangeReqQueue.Push(req, SonarReadTime)
 	if err := s.board.RoverSonarRead(); err != nil {
+		s.rangeReqQueue.Remove(req)
 		s.respQueue <- req
 		return fmt.Errorf("Error sending read sonar request to board id %s err - %s ", id, err)
 	} else {
 		fmt.Println("Sonar: sent read request id : ", id)
-		s.rangeReqQueue <- req
 		return nil
 	}
 }
 
 func (s *Sonar) processRangeResponse(data interface{}) {
 
-	req := <-s.rangeReqQueue
+	w, ok := s.rangeReqQueue.Pop()
+	if !ok {
+		fmt.Println("Sonar: Discarding range response with no pending request")
+		return
+	}
+	req := w.(SonarReq)
 	req.Result = int(data.(uint8))
 	s.respQueue <- req
 
 	fmt.Println("Sonar: Got response ", req.Result, " cm, assigning to ID ", req.ID)
 }
 
+// Turn points the sonar head angle degrees to the right or left of its
+// calibrated centre, within the calibrated limits and the reach of the
+// servo. The request is answered with the angle the head was turned to.
 func (s *Sonar) Turn(id string, direction string, angle int) error {
-	var dir byte
-	if direction == "right" {
-		dir = board.TurnRight
-	} else {
-		dir = board.TurnLeft
+	// target is the new head angle, positive to the right
+	target := angle
+	if direction != "right" {
+		target = -angle
+	}
+	if target > s.calibration.SonarRightLimit {
+		target = s.calibration.SonarRightLimit
+	} else if target < -s.calibration.SonarLeftLimit {
+		target = -s.calibration.SonarLeftLimit
+	}
+
+	// the firmware turns relative to its own idea of the centre
+	dir, angle := board.TurnRight, target+s.calibration.SonarCenter
+	if angle > SonarMaxAngle {
+		angle = SonarMaxAngle
+	} else if angle < -SonarMaxAngle {
+		angle = -SonarMaxAngle
+	}
+	target = angle - s.calibration.SonarCenter
+	if angle < 0 {
+		dir, angle = board.TurnLeft, -angle
 	}
-	angle = angle % 91
 
-	req := SonarReq{ID: id, reqType: SonarTurnReq, Result: 0}
+	req := SonarReq{ID: id, reqType: SonarTurnReq, Result: target}
+	s.turnReqQueue.Push(req, SonarTurnTime)
 	if err := s.board.RoverSonarTurn(dir, angle); err != nil {
+		s.turnReqQueue.Remove(req)
 		s.respQueue <- req
 		return fmt.Errorf("Error sending turn sonar request to board err - %s ", err)
 	} else {
 		fmt.Println("Sonar: sent turn request : ", direction, angle)
-		s.turnReqQueue <- req
 		return nil
 	}
 }
 
 func (s *Sonar) processTurnDone(data interface{}) {
-	req := <-s.turnReqQueue
+	req, ok := s.turnReqQueue.Pop()
+	if !ok {
+		fmt.Println("Sonar: Discarding turn response with no pending request")
+		return
+	}
 	s.respQueue <- req
 
-	fmt.Println("Sonar: Got turn response, assigning to ID ", req.ID)
+	fmt.Println("Sonar: Got turn response, assigning to ID ", req.GetID())
+}
+
+// StartMonitor reads the range in the background so that sensor conditions
+// stay current. Background readings have an empty ID. A reading is skipped
+// while the previous one is still outstanding, to keep the serial link free
+// for motion commands.
+func (s *Sonar) StartMonitor() {
+	s.monitor.Start(SonarMonitorInterval, func() {
+		if s.rangeReqQueue.Len() == 0 {
+			if err := s.ReadRange(""); err != nil {
+				fmt.Println("Sonar: monitor err - ", err)
+			}
+		}
+	})
+}
+
+func (s *Sonar) StopMonitor() {
+	s.monitor.Stop()
+}
+
+func (s *Sonar) FlushRequests() {
+	s.rangeReqQueue.Flush()
+	s.turnReqQueue.Flush()
+}
+
+func (s *Sonar) ExpireRequests(now time.Time) []Work {
+	return append(s.rangeReqQueue.Expire(now), s.turnReqQueue.Expire(now)...)
 }
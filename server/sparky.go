@@ -1,176 +1,1272 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var comPort string
-var rover Rover
-var workResponseQueue = make(chan Work, 100)
-var pendingReqs = make(map[string]string)
-var lastCmdTime time.Time
-var lastPendingTime time.Time
+// Server owns a rover connection together with the table of pending Scratch
+// requests, the last sensor readings and the heartbeat timers. All of its
+// state is guarded by mu, so a Server can be shared by concurrent HTTP
+// handlers and several servers can run side by side in one process.
+type Server struct {
+	comPort           string
+	rover             Rover
+	workResponseQueue chan Work
+	sensors           *SensorState
+	profiles          *ProfileStore
+	events            *EventStream
+	odometry          *Odometry
+	grid              *OccupancyGrid
+	mapsDir           string
+	// done is closed by Close to stop the background work
+	done      chan struct{}
+	closeOnce sync.Once
 
-func HandlePoll(w http.ResponseWriter, r *http.Request) {
+	mu sync.Mutex
+	// connecting is set while the rover is being set up
+	connecting     bool
+	pendingReqs    map[string]string
+	conditions     map[string]Condition
+	waiters        map[string]chan Work
+	lastInternalID int
+	task           *Task
+	sweep          *SweepResult
+	lineFollow     LineFollowSettings
+	lineStream     bool
+	// watching holds the sensors the project watches for its condition
+	// blocks, which are only read in the background while watched
+	watching map[string]bool
+	// trajectory is the path the trajectory blocks build up, and
+	// trajectorySegment the one being driven, from 1
+	trajectory        Trajectory
+	trajectorySegment int
+	// motionPolicy is what the wheels do with a motion command arriving
+	// during a step or turn, kept across reconnections
+	motionPolicy string
+	gridNav      GridPosition
+	// cliffGuard stops the rover at table edges, cliff is set when it did
+	// until the next motion command
+	cliffGuard bool
+	cliff      bool
+	// safetyOn slows down and stops the rover ahead of obstacles, safetyZone
+	// is where the last range ahead fell and obstacleStop is set when the
+	// rover was stopped, until the next motion command
+	safetyOn     bool
+	safety       SafetySettings
+	safetyZone   string
+	obstacleStop bool
+	// clientTimeout is how long the client may stay silent, 0 for ever,
+	// before the watchdog stops the rover and marks the session orphaned.
+	// silent is set while the client has not come back since.
+	clientTimeout   time.Duration
+	lastClientTime  time.Time
+	silent          bool
+	orphaned        bool
+	watchdog        *Monitor
+	problems        []string
+	lastCmdTime     time.Time
+	lastPendingTime time.Time
+}
+
+func CreateServer(comPort string, profiles *ProfileStore) *Server {
+	events := NewEventStream()
+	s := &Server{
+		comPort:           comPort,
+		workResponseQueue: make(chan Work, 100),
+		sensors:           NewSensorState(),
+		profiles:          profiles,
+		events:            events,
+		odometry:          NewOdometry(events),
+		grid:              NewOccupancyGrid(),
+		mapsDir:           filepath.Join(filepath.Dir(profiles.path), "maps"),
+		pendingReqs:       make(map[string]string),
+		conditions:        CreateConditions(),
+		watching:          make(map[string]bool),
+		waiters:           make(map[string]chan Work),
+		lineFollow:        DefaultLineFollowSettings(),
+		motionPolicy:      MotionWait,
+		trajectory:        NewTrajectory(),
+		safety:            DefaultSafetySettings(),
+		safetyZone:        SafetyClear,
+		clientTimeout:     DefaultClientTimeout,
+		lastClientTime:    time.Now(),
+		watchdog:          NewMonitor(),
+		done:              make(chan struct{}),
+		lastCmdTime:       time.Now(),
+		lastPendingTime:   time.Now(),
+	}
+	go s.dispatchResponses()
+	s.watchdog.Start(WatchdogInterval, s.checkClient)
+	return s
+}
+
+// Close stops the server's background work and releases the board, so that
+// the server can be dropped while others keep running.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.watchdog.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopTask()
+	if s.rover.Connected() {
+		s.rover.Disconnect()
+	}
+}
+
+// closed tells whether Close was called.
+func (s *Server) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// connect sets up the rover in the background, as that takes over a second
+// of blinking and beeping during which the server has to keep answering.
+// The rover is only handed to the server once it is ready. Must be called
+// with s.mu held.
+func (s *Server) connect() {
+	if s.connecting || s.closed() {
+		return
+	}
+	s.connecting = true
+	profile, cal := s.profiles.ForRobot(s.comPort)
+	fmt.Println("Using calibration profile ", profile)
+
+	go func() {
+		var rover Rover
+		err := rover.Setup(s.comPort, s.workResponseQueue, cal, s.odometry)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.connecting = false
+		if err != nil {
+			return
+		}
+		if s.closed() {
+			rover.Disconnect()
+			return
+		}
+		s.rover = rover
+		for key := range s.pendingReqs {
+			delete(s.pendingReqs, key)
+		}
+		s.rover.wheels.SetPolicy(s.motionPolicy)
+		s.updateMonitors()
+	}()
+}
+
+// dispatchResponses completes pending requests as the devices answer them
+// and records the readings they carry. Responses with an empty ID come from
+// the background monitors and only update the readings, responses to tasks
+// are handed to the waiting task.
+func (s *Server) dispatchResponses() {
+	for {
+		var resp Work
+		select {
+		case <-s.done:
+			return
+		case resp = <-s.workResponseQueue:
+		}
 
-	if !rover.Connected() {
-		if err := rover.Setup(comPort, workResponseQueue); err == nil {
-			for key := range pendingReqs {
-				delete(pendingReqs, key)
+		s.mu.Lock()
+		if resp.GetID() == "" {
+			s.updateSensors(resp)
+		} else if waiter, ok := s.waiters[resp.GetID()]; ok {
+			s.updateSensors(resp)
+			select {
+			case waiter <- resp:
+			default:
+				fmt.Println("Discarding extra response for ID: ", resp.GetID(), " type: ", resp.GetType())
 			}
+		} else if _, ok := s.pendingReqs[resp.GetID()]; ok {
+			delete(s.pendingReqs, resp.GetID())
+			fmt.Println("Response ID: ", resp.GetID(), " type: ", resp.GetType(), " value: ", resp.GetRespValue())
+			s.updateSensors(resp)
+		} else {
+			// answer to a request that was reset or has timed out
+			fmt.Println("Discarding response for ID: ", resp.GetID(), " type: ", resp.GetType())
 		}
+		if resp.GetType() == SonarRangeReq {
+			s.mapRange(resp)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// updateSensors records the reading a response carries, and publishes the
+// line edges it shows. Must be called with s.mu held.
+func (s *Server) updateSensors(resp Work) {
+	if edge := s.sensors.Update(resp); edge != nil {
+		fmt.Println("Line ", edge.Key(), " crossings ", edge.Crossings)
+		s.events.Publish("line", edge)
+	}
+	switch resp.GetType() {
+	case LineLeftResp, LineRightResp:
+		s.checkCliff()
+	case SonarRangeReq:
+		s.checkSafety()
 	}
+}
+
+// mapRange adds a range reading to the occupancy grid at the current pose.
+// Readings of requests that failed carry MAX_DISTANCE and are left out.
+func (s *Server) mapRange(resp Work) {
+	value, err := strconv.Atoi(resp.GetRespValue())
+	if err != nil || value > SonarMaxRange {
+		return
+	}
+	s.grid.AddReading(s.odometry.Pose(), s.sensors.SonarAngle(), value)
+}
+
+func (s *Server) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if !rover.Connected() {
+	if !s.rover.Connected() {
+		s.connect()
+	}
+
+	s.sensors.SetConnected(s.rover.Connected())
+	s.sensors.WriteReporters(w)
+	s.odometry.WriteReporters(w)
+	if s.sweep != nil {
+		s.sweep.WriteReporters(w)
+	}
+	if s.rover.Connected() {
+		state, waiting := s.rover.wheels.State()
+		fmt.Fprintf(w, "wheelsState %s\n", state)
+		fmt.Fprintf(w, "motionsWaiting %d\n", waiting)
+	}
+	fmt.Fprintf(w, "exploring %t\n", s.task != nil && s.task.name == ExploreTask)
+	fmt.Fprintf(w, "followingLine %t\n", s.task != nil && s.task.name == LineFollowTask)
+	fmt.Fprintf(w, "drivingTrajectory %t\n", s.task != nil && s.task.name == TrajectoryTask)
+	fmt.Fprintf(w, "trajectorySegment %d\n", s.trajectorySegment)
+	fmt.Fprintf(w, "cliffDetected %t\n", s.cliff)
+	fmt.Fprintf(w, "safetyZone %s\n", s.safetyZone)
+	fmt.Fprintf(w, "obstacleStop %t\n", s.obstacleStop)
+	fmt.Fprintf(w, "orphaned %t\n", s.orphaned)
+	fmt.Fprintf(w, "gridX %d\n", s.gridNav.X)
+	fmt.Fprintf(w, "gridY %d\n", s.gridNav.Y)
+	fmt.Fprintf(w, "gridHeading %d\n", s.gridNav.Heading)
+	for key, cond := range s.conditions {
+		fmt.Fprintf(w, "%s %t\n", key, cond.Test(s.sensors))
+	}
+
+	if !s.rover.Connected() {
 		fmt.Fprintln(w, "_problem Roverduino is not connected")
-	} else {
-		done := false
-		for !done {
-			select {
-			case resp := <-workResponseQueue:
-				delete(pendingReqs, resp.GetID())
-
-				switch resp.GetType() {
-				case SonarRangeReq:
-					fmt.Println("Sonar range ID: ", resp.GetID(), " value: ", resp.GetRespValue())
-					fmt.Fprintf(w, "sonarRange %s\n", resp.GetRespValue())
-				case LineLeftResp:
-					fmt.Println("Line Left ID: ", resp.GetID(), " value: ", resp.GetRespValue())
-					fmt.Fprintf(w, "lineLeft %s\n", resp.GetRespValue())
-				case LineRightResp:
-					fmt.Println("Line Right ID: ", resp.GetID(), " value: ", resp.GetRespValue())
-					fmt.Fprintf(w, "lineRight %s\n", resp.GetRespValue())
-				default:
-					break
-				}
-
-			case <-time.After(5 * time.Millisecond):
-				done = true
-			}
+		return
+	}
+
+	for _, req := range s.rover.ExpireRequests(time.Now()) {
+		fmt.Println("Request timed out ID: ", req.GetID(), " type: ", req.GetType())
+		if _, ok := s.pendingReqs[req.GetID()]; ok {
+			delete(s.pendingReqs, req.GetID())
+			fmt.Fprintf(w, "_problem Request %s timed out\n", req.GetID())
 		}
-		pending := ""
-		for key, _ := range pendingReqs {
-			pending = pending + " " + key
-		}
-		if pending != "" {
-			fmt.Fprintln(w, "_busy "+pending)
-			if time.Since(lastPendingTime) >= 5*time.Second {
-				if time.Since(lastCmdTime) >= time.Second {
-					fmt.Println("Rover - HeartBeat")
-					lastCmdTime = time.Now()
-					rover.heartBeat()
-				}
-			}
+	}
+	for _, problem := range s.problems {
+		fmt.Fprintln(w, "_problem "+problem)
+	}
+	s.problems = nil
+
+	pending := ""
+	for key := range s.pendingReqs {
+		pending = pending + " " + key
+	}
+	if pending != "" {
+		fmt.Fprintln(w, "_busy "+pending)
+		if time.Since(s.lastPendingTime) >= 5*time.Second {
+			s.heartBeat(w)
+		}
+	} else {
+		s.lastPendingTime = time.Now()
+		s.heartBeat(w)
+	}
+}
+
+// heartBeat pings the board at most once a second. If the board does not
+// answer the rover is disconnected, and the next poll tries to reconnect.
+// Must be called with s.mu held.
+func (s *Server) heartBeat(w http.ResponseWriter) {
+	if time.Since(s.lastCmdTime) < time.Second {
+		return
+	}
+	fmt.Println("Rover - HeartBeat")
+	s.lastCmdTime = time.Now()
+	if err := s.rover.heartBeat(); err != nil {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+	}
+}
+
+// HandleReset resets the rover and clears the pending requests, so that a new
+// script does not receive answers meant for the previous one.
+func (s *Server) HandleReset(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the server forgets the last project even when the board is gone.
+	// Responses still on their way are discarded by dispatchResponses.
+	s.stopTask()
+	s.cliff, s.obstacleStop, s.orphaned = false, false, false
+	s.problems = nil
+	for key := range s.pendingReqs {
+		delete(s.pendingReqs, key)
+	}
+	s.conditions = CreateConditions()
+	s.watching = make(map[string]bool)
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+
+	s.lastCmdTime = time.Now()
+	if err := s.rover.Reset(mux.Vars(r)); err != nil {
+		fmt.Fprintln(w, "_problem Could not execute command")
+	}
+	s.updateMonitors()
+}
+
+// startTask runs routine as the server's task, stopping the task running
+// before it. The Scratch request id, if any, stays pending until the routine
+// returns, and an error is reported to Scratch as a problem. Must be called
+// with s.mu held.
+func (s *Server) startTask(id string, name string, routine func(t *Task) error) {
+	s.stopTask()
+
+	t := &Task{server: s, name: name, stop: make(chan struct{})}
+	s.task = t
+	if id != "" {
+		s.pendingReqs[id] = id
+		s.lastPendingTime = time.Now()
+	}
+
+	fmt.Println("Starting task ", name)
+	go func() {
+		err := routine(t)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if err != nil && err != ErrTaskStopped {
+			fmt.Println("Task ", name, " failed - err ", err)
+			s.problems = append(s.problems, err.Error())
 		} else {
-			lastPendingTime = time.Now()
-			if time.Since(lastCmdTime) >= time.Second {
-				fmt.Println("Rover - HeartBeat")
-				lastCmdTime = time.Now()
-				rover.heartBeat()
-			}
+			fmt.Println("Task ", name, " finished")
 		}
+		delete(s.pendingReqs, id)
+		if s.task == t {
+			s.task = nil
+		}
+	}()
+}
+
+// stopTask stops the running task. Must be called with s.mu held.
+func (s *Server) stopTask() {
+	if s.task != nil {
+		fmt.Println("Stopping task ", s.task.name)
+		s.task.Stop()
+		s.task = nil
+	}
+}
+
+// abortMotion stops the wheels whatever moves them, and fails the task and
+// the motion requests in progress with a problem starting with reason. Must
+// be called with s.mu held.
+func (s *Server) abortMotion(reason string) {
+	fmt.Println(reason, ", stopping")
+	if s.task != nil {
+		s.problems = append(s.problems, fmt.Sprintf("%s, %s stopped", reason, s.task.name))
+		s.stopTask()
+	}
+	// flushed before stopping, as the firmware answers the step or turn it
+	// stops
+	for _, req := range s.rover.wheels.FlushRequests() {
+		if _, ok := s.pendingReqs[req.GetID()]; ok {
+			delete(s.pendingReqs, req.GetID())
+			s.problems = append(s.problems, fmt.Sprintf("%s, request %s stopped", reason, req.GetID()))
+		}
+	}
+	if err := s.rover.wheels.EmergencyStop(); err != nil {
+		fmt.Println("Could not stop wheels - err ", err)
+	}
+}
+
+// issue sends a rover command for a task under a new internal ID and
+// returns the channel its responses are delivered on.
+func (s *Server) issue(command func(r *Rover, id string) error, count int) (string, chan Work, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		return "", nil, fmt.Errorf("Rover not connected")
 	}
+
+	s.lastInternalID++
+	id := fmt.Sprintf("_%d", s.lastInternalID)
+	responses := make(chan Work, count)
+	s.waiters[id] = responses
+
+	s.lastCmdTime = time.Now()
+	if err := command(&s.rover, id); err != nil {
+		delete(s.waiters, id)
+		return "", nil, err
+	}
+	return id, responses, nil
+}
+
+func (s *Server) unregister(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.waiters, id)
 }
 
-func invokeHaandler(w http.ResponseWriter, handler func(map[string]string) error, vars map[string]string) error {
-	if !rover.Connected() {
+// updateMonitors runs the background readings of the sensors the project
+// watches and those needed by the features turned on. Must be called with
+// s.mu held.
+func (s *Server) updateMonitors() {
+	s.rover.Monitor(SonarSensor, s.watching[SonarSensor] || s.safetyOn)
+	s.rover.Monitor(LineSensors, s.watching[LineSensors])
+	s.rover.Monitor(LineStream, s.watching[LineStream] || s.lineStream || s.cliffGuard)
+}
+
+func (s *Server) invokeHandler(w http.ResponseWriter, handler func(map[string]string) error, vars map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
 		fmt.Fprintln(w, "_problem Roverduino is not connected")
 		return fmt.Errorf("Rover not connected")
 	}
 
-	lastCmdTime = time.Now()
+	s.lastCmdTime = time.Now()
 
 	id := vars["id"]
 	if err := handler(vars); err != nil {
+		fmt.Println("Command failed - err ", err)
 		fmt.Fprintln(w, "_problem Could not execute command")
 		return fmt.Errorf("Could not execute command")
 	} else if id != "" {
-		pendingReqs[id] = id
-		lastPendingTime = time.Now()
+		s.pendingReqs[id] = id
+		s.lastPendingTime = time.Now()
 	}
 	return nil
 }
 
-func HandleReset(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.Reset, mux.Vars(r))
+// handle adapts a rover command to an http.HandlerFunc. The rover method is
+// resolved when the request arrives, since the rover is set up lazily.
+func (s *Server) handle(command func(r *Rover, vars map[string]string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.invokeHandler(w, func(vars map[string]string) error {
+			return command(&s.rover, vars)
+		}, mux.Vars(r))
+	}
+}
+
+// handleMotion is handle for commands that move the rover. They take the
+// wheels back from a running task, so that manual control always wins.
+func (s *Server) handleMotion(command func(r *Rover, vars map[string]string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.invokeHandler(w, func(vars map[string]string) error {
+			s.stopTask()
+			s.cliff, s.obstacleStop, s.orphaned = false, false, false
+			return command(&s.rover, vars)
+		}, mux.Vars(r)); err == nil {
+			// stop right away when already too close, rather than at the
+			// next reading
+			s.mu.Lock()
+			s.checkSafety()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// HandleTurnCalibrate turns with an explicit turn rate and keeps that rate
+// in the robot's calibration profile.
+func (s *Server) HandleTurnCalibrate(w http.ResponseWriter, r *http.Request) {
+	if err := s.invokeHandler(w, func(vars map[string]string) error {
+		s.stopTask()
+		return s.rover.TurnCalibrate(vars)
+	}, mux.Vars(r)); err == nil {
+		s.mu.Lock()
+		s.saveProfiles()
+		s.mu.Unlock()
+	}
+}
+
+// HandleCalibrateTurn measures the turn rates with the sonar while the rover
+// faces a wall. The Scratch block completes when the calibration is done.
+func (s *Server) HandleCalibrateTurn(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	mode := vars["mode"]
+	if mode != TurnSpin {
+		mode = TurnPivot
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+	s.startTask(vars["id"], "turn calibration", func(t *Task) error {
+		return s.CalibrateTurn(t, mode)
+	})
+}
+
+// HandleCalibrateTrim runs the guided trim calibration. The rover has to
+// face a wall squarely, with room to drive towards it.
+func (s *Server) HandleCalibrateTrim(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+	s.startTask(mux.Vars(r)["id"], "trim calibration", s.CalibrateTrim)
+}
+
+// HandleScanSonar scans the surroundings with the sonar for Scratch. The
+// derived directions are reported on the following polls.
+func (s *Server) HandleScanSonar(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	step := sweepStep(vars["step"])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+	s.startTask(vars["id"], "sonar scan", func(t *Task) error {
+		_, err := s.ScanSonar(t, step)
+		return err
+	})
+}
+
+// HandleGetSonarScan writes the last sonar scan as JSON.
+func (s *Server) HandleGetSonarScan(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sweep == nil {
+		http.Error(w, "No sonar scan yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sweep)
+}
+
+// HandlePostSonarScan runs a sonar scan, every step degrees as given by the
+// step query parameter, and writes it as JSON once it is done.
+func (s *Server) HandlePostSonarScan(w http.ResponseWriter, r *http.Request) {
+	step := sweepStep(r.URL.Query().Get("step"))
+
+	s.mu.Lock()
+	if !s.rover.Connected() {
+		s.mu.Unlock()
+		http.Error(w, "Roverduino is not connected", http.StatusServiceUnavailable)
+		return
+	}
+	var result *SweepResult
+	done := make(chan error, 1)
+	s.startTask("", "sonar scan", func(t *Task) (err error) {
+		result, err = s.ScanSonar(t, step)
+		done <- err
+		return err
+	})
+	s.mu.Unlock()
+
+	if err := <-done; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// sweepStep parses the angle between scan readings, falling back to
+// SweepStep.
+func sweepStep(value string) int {
+	step, err := strconv.Atoi(value)
+	if err != nil || step <= 0 || step > 90 {
+		return SweepStep
+	}
+	return step
+}
+
+// HandleStartExplore starts the explore behaviour. The range to keep from
+// obstacles is taken from the path, and the speed from the speed query
+// parameter, defaulting to the firmware speed.
+func (s *Server) HandleStartExplore(w http.ResponseWriter, r *http.Request) {
+	stopRange, err := strconv.Atoi(mux.Vars(r)["range"])
+	if err != nil || stopRange <= 0 {
+		stopRange = ExploreStopRange
+	}
+	speed, _ := strconv.Atoi(r.URL.Query().Get("speed"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+	s.lastCmdTime = time.Now()
+	s.startTask("", ExploreTask, func(t *Task) error {
+		return s.Explore(t, stopRange, speed)
+	})
+}
+
+// HandleStopExplore stops the explore behaviour and the rover with it.
+func (s *Server) HandleStopExplore(w http.ResponseWriter, r *http.Request) {
+	s.stopBehaviour(w, ExploreTask)
+}
+
+// HandleStartLineFollow starts the line follower with the current settings.
+// A speed in the path overrides the speed setting for this run.
+func (s *Server) HandleStartLineFollow(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+	settings := s.lineFollow
+	if speed, err := strconv.Atoi(mux.Vars(r)["speed"]); err == nil {
+		settings.Speed = speed
+	}
+	s.lastCmdTime = time.Now()
+	s.startTask("", LineFollowTask, func(t *Task) error {
+		return s.FollowLine(t, settings)
+	})
+}
+
+// HandleStopLineFollow stops the line follower and the rover with it.
+func (s *Server) HandleStopLineFollow(w http.ResponseWriter, r *http.Request) {
+	s.stopBehaviour(w, LineFollowTask)
+}
+
+func (s *Server) HandleGetLineFollow(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.lineFollow)
+}
+
+// HandlePutLineFollow replaces the line follow settings with the JSON in the
+// request body. Fields missing from the body are left as is. A running line
+// follower keeps the settings it was started with.
+func (s *Server) HandlePutLineFollow(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := s.lineFollow
+	if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid line follow settings - %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := updated.SetRecovery(updated.Recovery); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lineFollow = updated
 }
 
-func HandleReadSonar(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.ReadSonar, mux.Vars(r))
+// HandleSetLineFollow sets a single line follow setting, for use from
+// Scratch.
+func (s *Server) HandleSetLineFollow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	value, err := strconv.ParseFloat(vars["value"], 64)
+	if err != nil {
+		fmt.Fprintln(w, "_problem Invalid line follow value ", vars["value"])
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.lineFollow.Set(vars["field"], value); err != nil {
+		fmt.Fprintln(w, "_problem ", err)
+	}
 }
 
-func HandleTurnSonar(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.TurnSonar, mux.Vars(r))
+func (s *Server) HandleLineRecovery(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.lineFollow.SetRecovery(mux.Vars(r)["recovery"]); err != nil {
+		fmt.Fprintln(w, "_problem ", err)
+	}
 }
 
-func HandleCenterSonar(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.CenterSonar, mux.Vars(r))
+// HandleGridForward follows the line for a number of grid cells.
+func (s *Server) HandleGridForward(w http.ResponseWriter, r *http.Request) {
+	cells, _ := strconv.Atoi(mux.Vars(r)["cells"])
+	s.handleGrid(w, r, func(t *Task, settings LineFollowSettings) error {
+		return s.GridForward(t, settings, cells)
+	})
 }
 
-func HandleRun(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.Run, mux.Vars(r))
+// HandleGridTurn turns right or left at the next intersection.
+func (s *Server) HandleGridTurn(w http.ResponseWriter, r *http.Request) {
+	degrees := 90
+	if mux.Vars(r)["dir"] == "left" {
+		degrees = -90
+	}
+	s.handleGrid(w, r, func(t *Task, settings LineFollowSettings) error {
+		return s.GridTurn(t, settings, degrees)
+	})
 }
 
-func HandleStop(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.Stop, mux.Vars(r))
+// HandleGridGoTo drives to a grid cell.
+func (s *Server) HandleGridGoTo(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+	s.handleGrid(w, r, func(t *Task, settings LineFollowSettings) error {
+		return s.GridGoTo(t, settings, x, y)
+	})
 }
 
-func HandleTurnCalibrate(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.TurnCalibrate, mux.Vars(r))
+// handleGrid runs a grid navigation routine as the server's task, with the
+// current line follow settings. The rover is stopped if the routine fails.
+func (s *Server) handleGrid(w http.ResponseWriter, r *http.Request, routine func(t *Task, settings LineFollowSettings) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+	settings := s.lineFollow
+	s.lastCmdTime = time.Now()
+	s.startTask(mux.Vars(r)["id"], GridNavigationTask, func(t *Task) error {
+		err := routine(t, settings)
+		if err != nil && err != ErrTaskStopped {
+			s.stopWheels()
+		}
+		return err
+	})
 }
 
-func HandleTurn(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.Turn, mux.Vars(r))
+// HandleSetGridCell tells the server which cell the rover stands on and
+// which way it faces.
+func (s *Server) HandleSetGridCell(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+	heading, _ := strconv.Atoi(vars["heading"])
+	s.setGridPosition(GridPosition{X: x, Y: y}.Turned(heading / 90 * 90))
 }
 
-func HandleReverseTurn(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.ReverseTurn, mux.Vars(r))
+func (s *Server) HandleGetGridCell(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.gridPosition())
 }
 
-func HandleStep(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.Step, mux.Vars(r))
+// HandleCliffGuard turns the table edge protection on or off. It keeps the
+// line sensors streaming while on. It can only be turned on once the line
+// sensors are calibrated, as uncalibrated sensors take any line for a cliff.
+func (s *Server) HandleCliffGuard(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	on := mux.Vars(r)["state"] == "on"
+	if _, cal := s.profiles.ForRobot(s.comPort); on && !cal.LineCalibrated() {
+		fmt.Fprintln(w, "_problem Calibrate the line sensors before turning on table edge protection")
+		return
+	}
+	s.cliffGuard = on
+	s.cliff = false
+	fmt.Println("Cliff guard ", s.cliffGuard)
+	s.updateMonitors()
 }
 
-func HandleWheelStep(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.WheelStep, mux.Vars(r))
+// HandleSafety turns the obstacle protection on or off. It keeps the sonar
+// reading while on.
+func (s *Server) HandleSafety(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setSafety(mux.Vars(r)["state"] == "on")
 }
 
-func HandleLightOn(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.LightOn, mux.Vars(r))
+func (s *Server) HandleGetSafety(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"on":           s.safetyOn,
+		"zone":         s.safetyZone,
+		"obstacleStop": s.obstacleStop,
+		"settings":     s.safety,
+	})
 }
 
-func HandleLightColor(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.LightColor, mux.Vars(r))
+// HandleSetSafety sets a single obstacle protection setting, for use from
+// Scratch.
+func (s *Server) HandleSetSafety(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	value, err := strconv.ParseFloat(vars["value"], 64)
+	if err != nil {
+		fmt.Fprintln(w, "_problem Invalid obstacle protection value ", vars["value"])
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.safety.Set(vars["field"], value); err != nil {
+		fmt.Fprintln(w, "_problem ", err)
+		return
+	}
+	s.checkSafety()
 }
 
-func HandleLightOff(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.LightOff, mux.Vars(r))
+func (s *Server) HandleGetTrajectory(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.trajectory)
 }
 
-func HandlePlayToneFor(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.PlayToneFor, mux.Vars(r))
+// HandlePutTrajectory replaces the trajectory with the JSON in the request
+// body, either segments or waypoints.
+func (s *Server) HandlePutTrajectory(w http.ResponseWriter, r *http.Request) {
+	tr := NewTrajectory()
+	if err := json.NewDecoder(r.Body).Decode(&tr); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid trajectory - %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := tr.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trajectory = tr
 }
 
-func HandlePlayTone(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.PlayTone, mux.Vars(r))
+// HandleClearTrajectory empties the trajectory, keeping its speed.
+func (s *Server) HandleClearTrajectory(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trajectory = Trajectory{Speed: s.trajectory.Speed}
 }
 
-func HandleBuzzerOff(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.BuzzerOff, mux.Vars(r))
+// HandleAddSegment adds a segment to the trajectory, for use from Scratch.
+func (s *Server) HandleAddSegment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	speed, err1 := strconv.ParseFloat(vars["speed"], 64)
+	turnRate, err2 := strconv.ParseFloat(vars["turnRate"], 64)
+	duration, err3 := strconv.ParseFloat(vars["duration"], 64)
+	if err1 != nil || err2 != nil || err3 != nil || duration <= 0 {
+		fmt.Fprintln(w, "_problem Invalid trajectory segment")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trajectory.Segments = append(s.trajectory.Segments, Segment{Speed: speed, TurnRate: turnRate, Duration: duration})
 }
 
-func HandleBeep(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.Beep, mux.Vars(r))
+// HandleAddWaypoint adds a waypoint to the trajectory, for use from Scratch.
+func (s *Server) HandleAddWaypoint(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	x, err1 := strconv.ParseFloat(vars["x"], 64)
+	y, err2 := strconv.ParseFloat(vars["y"], 64)
+	if err1 != nil || err2 != nil {
+		fmt.Fprintln(w, "_problem Invalid waypoint")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trajectory.Waypoints = append(s.trajectory.Waypoints, Waypoint{X: x, Y: y})
 }
 
-func HandleReadLineSensor(w http.ResponseWriter, r *http.Request) {
-	invokeHaandler(w, rover.ReadLineSensor, mux.Vars(r))
+func (s *Server) HandleTrajectorySpeed(w http.ResponseWriter, r *http.Request) {
+	speed, err := strconv.ParseFloat(mux.Vars(r)["speed"], 64)
+	if err != nil || speed <= 0 {
+		fmt.Fprintln(w, "_problem Invalid trajectory speed ", mux.Vars(r)["speed"])
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trajectory.Speed = speed
+}
+
+// HandleDriveTrajectory drives the trajectory. The Scratch block, if any,
+// completes at its end.
+func (s *Server) HandleDriveTrajectory(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+	tr := s.trajectory
+	if err := tr.Validate(); err != nil {
+		fmt.Fprintln(w, "_problem ", err)
+		return
+	}
+	s.lastCmdTime = time.Now()
+	s.cliff, s.obstacleStop, s.orphaned = false, false, false
+	s.startTask(mux.Vars(r)["id"], TrajectoryTask, func(t *Task) error {
+		return s.DriveTrajectory(t, tr)
+	})
+}
+
+// HandleStopTrajectory stops driving the trajectory and the rover with it.
+func (s *Server) HandleStopTrajectory(w http.ResponseWriter, r *http.Request) {
+	s.stopBehaviour(w, TrajectoryTask)
+}
+
+// HandleMotionPolicy sets whether a motion command arriving during a step
+// or turn waits for it, replaces it or is rejected.
+func (s *Server) HandleMotionPolicy(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policy := mux.Vars(r)["policy"]
+	if s.rover.Connected() {
+		if err := s.rover.wheels.SetPolicy(policy); err != nil {
+			fmt.Fprintln(w, "_problem ", err)
+			return
+		}
+	}
+	s.motionPolicy = policy
+	fmt.Println("Motion policy ", policy)
+}
+
+// HandleClientTimeout sets how many seconds the client may stay silent
+// before the rover is stopped. 0 turns the watchdog off.
+func (s *Server) HandleClientTimeout(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.ParseFloat(mux.Vars(r)["seconds"], 64)
+	if err != nil || seconds < 0 {
+		fmt.Fprintln(w, "_problem Invalid client timeout ", mux.Vars(r)["seconds"])
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientTimeout = time.Duration(seconds * float64(time.Second))
+	fmt.Println("Client timeout ", s.clientTimeout)
+}
+
+// HandleWatch starts or stops reading a sensor in the background for the
+// condition blocks. Scratch only reads the conditions from the poll, so the
+// server can not tell which ones a project uses, and leaves the serial link
+// free until the project asks for them.
+func (s *Server) HandleWatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.watching[Watched[vars["sensor"]]] = vars["state"] == "on"
+	fmt.Println("Watching ", vars["sensor"], " ", vars["state"])
+	s.updateMonitors()
+}
+
+// HandleLineStream turns streaming of the line sensors on or off. While on,
+// every line sensor change is published on the event stream.
+func (s *Server) HandleLineStream(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lineStream = mux.Vars(r)["state"] == "on"
+	s.updateMonitors()
+}
+
+// HandleGetLineStream writes the line sensor state and the crossings counted
+// as JSON.
+func (s *Server) HandleGetLineStream(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	left, right := s.sensors.Lines()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"streaming": s.rover.Connected() && s.rover.lineSensor.Streaming(),
+		"left":      left,
+		"right":     right,
+		"crossings": s.sensors.LineCrossings(),
+	})
+}
+
+func (s *Server) HandleResetLineCrossings(w http.ResponseWriter, r *http.Request) {
+	s.sensors.ResetLineCrossings()
+}
+
+// stopBehaviour stops the task called name, if it is running, and the rover
+// with it.
+func (s *Server) stopBehaviour(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.task == nil || s.task.name != name {
+		return
+	}
+	s.stopTask()
+	if s.rover.Connected() {
+		s.lastCmdTime = time.Now()
+		if err := s.rover.wheels.Stop(); err != nil {
+			fmt.Fprintln(w, "_problem Could not execute command")
+		}
+	}
+}
+
+// HandleCalibrateLine samples the line sensors over a black or a white
+// surface to set their thresholds.
+func (s *Server) HandleCalibrateLine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rover.Connected() {
+		fmt.Fprintln(w, "_problem Roverduino is not connected")
+		return
+	}
+	s.startTask(vars["id"], "line calibration", func(t *Task) error {
+		return s.CalibrateLine(t, vars["surface"])
+	})
+}
+
+// HandleGetCalibration writes the robot's calibration profile as JSON.
+func (s *Server) HandleGetCalibration(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	profile, cal := s.profiles.ForRobot(s.comPort)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": profile, "calibration": cal})
+}
+
+// HandlePutCalibration replaces the robot's calibration profile with the
+// JSON in the request body. Fields missing from the body are left as is.
+func (s *Server) HandlePutCalibration(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, cal := s.profiles.ForRobot(s.comPort)
+	updated := *cal
+	if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid calibration - %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := updated.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	*cal = updated
+	s.saveProfiles()
+	if s.rover.Connected() {
+		s.rover.wheels.ApplyTrim()
+	}
+	s.updateMonitors()
+}
+
+// HandleSetCalibration sets a single calibration field, for use from Scratch.
+func (s *Server) HandleSetCalibration(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	value, err := strconv.ParseFloat(vars["value"], 64)
+	if err != nil {
+		fmt.Fprintln(w, "_problem Invalid calibration value ", vars["value"])
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, cal := s.profiles.ForRobot(s.comPort)
+	if err := cal.Set(vars["field"], value); err != nil {
+		fmt.Fprintln(w, "_problem ", err)
+		return
+	}
+	s.saveProfiles()
+	if s.rover.Connected() {
+		s.rover.wheels.ApplyTrim()
+	}
+	s.updateMonitors()
+}
+
+// HandleSetTrim sets the wheel trim and keeps it in the robot's calibration
+// profile.
+func (s *Server) HandleSetTrim(w http.ResponseWriter, r *http.Request) {
+	if err := s.invokeHandler(w, s.rover.SetTrim, mux.Vars(r)); err == nil {
+		s.mu.Lock()
+		s.saveProfiles()
+		s.mu.Unlock()
+	}
+}
+
+// HandleUseProfile switches the robot to the named calibration profile, and
+// remembers the choice for the next time it connects.
+func (s *Server) HandleUseProfile(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Println("Using calibration profile ", name)
+	cal := s.profiles.Use(s.comPort, name)
+	if s.rover.Connected() {
+		if err := s.rover.SetCalibration(cal); err != nil {
+			fmt.Println("Could not apply calibration profile - err ", err)
+		}
+	}
+	s.updateMonitors()
+	s.saveProfiles()
+}
+
+func (s *Server) HandleListProfiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.profiles.Names())
+}
+
+// HandlePose writes the estimated pose as JSON.
+func (s *Server) HandlePose(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pose":   s.odometry.Pose(),
+		"moving": s.odometry.Moving(),
+	})
+}
+
+// HandleSetOrigin makes the rover's current pose the origin.
+func (s *Server) HandleSetOrigin(w http.ResponseWriter, r *http.Request) {
+	s.odometry.SetOrigin()
+}
+
+// HandleMapJSON writes the occupancy grid as JSON. Cells are listed row by
+// row from the row nearest y = 0, as percentages of occupancy with -1 for
+// unknown cells. The origin is the position of the first cell's lower left
+// corner, in cm.
+func (s *Server) HandleMapJSON(w http.ResponseWriter, r *http.Request) {
+	gw, data := s.grid.Occupancy()
+	x, y := gw.Origin()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"resolution": GridResolution,
+		"width":      gw.Width,
+		"height":     gw.Height,
+		"origin":     map[string]float64{"x": x, "y": y},
+		"pose":       s.odometry.Pose(),
+		"data":       data,
+	})
+}
+
+func (s *Server) HandleMapPNG(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	if err := s.grid.WritePNG(w); err != nil {
+		fmt.Println("Could not write map - err ", err)
+	}
+}
+
+func (s *Server) HandleMapPGM(w http.ResponseWriter, r *http.Request) {
+	_, img := s.grid.Image()
+	w.Header().Set("Content-Type", "image/x-portable-graymap")
+	if err := WritePGM(w, img); err != nil {
+		fmt.Println("Could not write map - err ", err)
+	}
+}
+
+func (s *Server) HandleMapYAML(w http.ResponseWriter, r *http.Request) {
+	gw, _ := s.grid.Occupancy()
+	w.Header().Set("Content-Type", "application/x-yaml")
+	WriteMapYAML(w, gw, "map.pgm")
+}
+
+func (s *Server) HandleClearMap(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Clearing map")
+	s.grid.Clear()
+}
+
+var mapNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// HandleSaveMap exports the occupancy grid as name.pgm and name.yaml, for
+// the ROS map_server, in the maps directory next to the calibration
+// profiles.
+func (s *Server) HandleSaveMap(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !mapNamePattern.MatchString(name) {
+		fmt.Fprintln(w, "_problem Map names may only have letters, digits, - and _")
+		return
+	}
+	if err := s.saveMap(name); err != nil {
+		fmt.Println("Could not save map - err ", err)
+		fmt.Fprintln(w, "_problem Could not save map ", name)
+	}
+}
+
+func (s *Server) saveMap(name string) error {
+	if err := os.MkdirAll(s.mapsDir, 0755); err != nil {
+		return err
+	}
+	gw, img := s.grid.Image()
+
+	pgm, err := os.Create(filepath.Join(s.mapsDir, name+".pgm"))
+	if err != nil {
+		return err
+	}
+	defer pgm.Close()
+	if err := WritePGM(pgm, img); err != nil {
+		return err
+	}
+
+	yaml, err := os.Create(filepath.Join(s.mapsDir, name+".yaml"))
+	if err != nil {
+		return err
+	}
+	defer yaml.Close()
+	if err := WriteMapYAML(yaml, gw, name+".pgm"); err != nil {
+		return err
+	}
+	fmt.Println("Saved map to ", filepath.Join(s.mapsDir, name+".yaml"))
+	return nil
+}
+
+func (s *Server) saveProfiles() {
+	if err := s.profiles.Save(); err != nil {
+		fmt.Println("Could not save calibration profiles - err ", err)
+	}
 }
 
 func HandleCrossDomainReq(w http.ResponseWriter, r *http.Request) {
@@ -180,36 +1276,124 @@ func HandleCrossDomainReq(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "</cross-domain-policy>")
 }
 
+// Router returns the HTTP routes of the Scratch extension protocol.
+func (s *Server) Router() *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+
+	router.HandleFunc("/crossdomain.xml", HandleCrossDomainReq)
+	router.HandleFunc("/poll", s.HandlePoll)
+	router.HandleFunc("/reset_all", s.HandleReset)
+	router.HandleFunc("/readSonar/{id}", s.handle((*Rover).ReadSonar))
+	router.HandleFunc("/turnSonar/{id}/{dir}/{angle}", s.handle((*Rover).TurnSonar))
+	router.HandleFunc("/centerSonar/{id}", s.handle((*Rover).CenterSonar))
+	router.HandleFunc("/run/{dir}", s.handleMotion((*Rover).Run))
+	router.HandleFunc("/runSpeed/{dir}/{speed}", s.handleMotion((*Rover).RunSpeed))
+	router.HandleFunc("/drive/{left}/{right}", s.handleMotion((*Rover).Drive))
+	router.HandleFunc("/curve/{linear}/{angular}", s.handleMotion((*Rover).Curve))
+	router.HandleFunc("/stop", s.handleMotion((*Rover).Stop))
+	// the turn block gave way to turnAngle, projects saved with it still
+	// send turn
+	router.HandleFunc("/turn/{id}/{dir}/{angle}", s.handleMotion((*Rover).Turn))
+	router.HandleFunc("/turnMode/{id}/{mode:pivot|spin}/{dir}/{angle}", s.handleMotion((*Rover).Turn))
+	router.HandleFunc("/turnCalibrate/{id}/{dir}/{angle}/{steps}", s.HandleTurnCalibrate)
+	router.HandleFunc("/reverseTurn/{id}/{dir}/{angle}", s.handleMotion((*Rover).ReverseTurn))
+	router.HandleFunc("/step/{id}/{dir}/{steps}", s.handleMotion((*Rover).Step))
+	router.HandleFunc("/driveDistance/{id}/{dir}/{cm}", s.handleMotion((*Rover).DriveDistance))
+	router.HandleFunc("/driveFor/{id}/{dir}/{seconds}", s.handleMotion((*Rover).DriveFor))
+	router.HandleFunc("/turnAngle/{id}/{dir}/{degrees}", s.handleMotion((*Rover).TurnAngle))
+	router.HandleFunc("/wheelStep/{id}/{which}/{dir}/{steps}", s.handleMotion((*Rover).WheelStep))
+	router.HandleFunc("/lightOn/{red}/{green}/{blue}", s.handle((*Rover).LightOn))
+	router.HandleFunc("/lightColor/{color}", s.handle((*Rover).LightColor))
+	router.HandleFunc("/lightOff", s.handle((*Rover).LightOff))
+	router.HandleFunc("/playToneFor/{id}/{freq}/{delay}", s.handle((*Rover).PlayToneFor))
+	router.HandleFunc("/playTone/{freq}", s.handle((*Rover).PlayTone))
+	router.HandleFunc("/buzzerOff", s.handle((*Rover).BuzzerOff))
+	router.HandleFunc("/beep", s.handle((*Rover).Beep))
+	router.HandleFunc("/readLineSensor/{id}", s.handle((*Rover).ReadLineSensor))
+	router.HandleFunc("/calibrateTurn/{id}", s.HandleCalibrateTurn)
+	router.HandleFunc("/calibrateTurn/{id}/{mode}", s.HandleCalibrateTurn)
+	router.HandleFunc("/calibrateTrim/{id}", s.HandleCalibrateTrim)
+	router.HandleFunc("/setTrim/{left}/{right}", s.HandleSetTrim)
+	router.HandleFunc("/calibrateLine/{id}/{surface:black|white}", s.HandleCalibrateLine)
+	router.HandleFunc("/calibration", s.HandleGetCalibration).Methods("GET")
+	router.HandleFunc("/calibration", s.HandlePutCalibration).Methods("PUT", "POST")
+	router.HandleFunc("/setCalibration/{field}/{value}", s.HandleSetCalibration)
+	router.HandleFunc("/calibrationProfile/{name}", s.HandleUseProfile)
+	router.HandleFunc("/calibrationProfiles", s.HandleListProfiles)
+	router.HandleFunc("/scanSonar/{id}/{step}", s.HandleScanSonar)
+	router.HandleFunc("/sonarScan", s.HandleGetSonarScan).Methods("GET")
+	router.HandleFunc("/sonarScan", s.HandlePostSonarScan).Methods("POST")
+	router.HandleFunc("/startExplore", s.HandleStartExplore)
+	router.HandleFunc("/startExplore/{range}", s.HandleStartExplore)
+	router.HandleFunc("/stopExplore", s.HandleStopExplore)
+	router.HandleFunc("/startLineFollow", s.HandleStartLineFollow)
+	router.HandleFunc("/startLineFollow/{speed}", s.HandleStartLineFollow)
+	router.HandleFunc("/stopLineFollow", s.HandleStopLineFollow)
+	router.HandleFunc("/lineFollow", s.HandleGetLineFollow).Methods("GET")
+	router.HandleFunc("/lineFollow", s.HandlePutLineFollow).Methods("PUT", "POST")
+	router.HandleFunc("/setLineFollow/{field}/{value}", s.HandleSetLineFollow)
+	router.HandleFunc("/lineRecovery/{recovery}", s.HandleLineRecovery)
+	router.HandleFunc("/lineStream", s.HandleGetLineStream)
+	router.HandleFunc("/lineStream/{state:on|off}", s.HandleLineStream)
+	router.HandleFunc("/watch/{sensor:sonar|line}/{state:on|off}", s.HandleWatch)
+	router.HandleFunc("/resetLineCrossings", s.HandleResetLineCrossings)
+	router.HandleFunc("/cliffGuard/{state:on|off}", s.HandleCliffGuard)
+	router.HandleFunc("/safety", s.HandleGetSafety)
+	router.HandleFunc("/safety/{state:on|off}", s.HandleSafety)
+	router.HandleFunc("/setSafety/{field}/{value}", s.HandleSetSafety)
+	router.HandleFunc("/clientTimeout/{seconds}", s.HandleClientTimeout)
+	router.HandleFunc("/motionPolicy/{policy:wait|replace|reject}", s.HandleMotionPolicy)
+	router.HandleFunc("/trajectory", s.HandleGetTrajectory).Methods("GET")
+	router.HandleFunc("/trajectory", s.HandlePutTrajectory).Methods("PUT", "POST")
+	router.HandleFunc("/clearTrajectory", s.HandleClearTrajectory)
+	router.HandleFunc("/addSegment/{speed}/{turnRate}/{duration}", s.HandleAddSegment)
+	router.HandleFunc("/addWaypoint/{x}/{y}", s.HandleAddWaypoint)
+	router.HandleFunc("/trajectorySpeed/{speed}", s.HandleTrajectorySpeed)
+	router.HandleFunc("/driveTrajectory", s.HandleDriveTrajectory)
+	router.HandleFunc("/driveTrajectory/{id}", s.HandleDriveTrajectory)
+	router.HandleFunc("/stopTrajectory", s.HandleStopTrajectory)
+	router.HandleFunc("/gridForward/{id}/{cells}", s.HandleGridForward)
+	router.HandleFunc("/gridTurn/{id}/{dir}", s.HandleGridTurn)
+	router.HandleFunc("/gridGoTo/{id}/{x}/{y}", s.HandleGridGoTo)
+	router.HandleFunc("/setGridCell/{x}/{y}/{heading}", s.HandleSetGridCell)
+	router.HandleFunc("/gridCell", s.HandleGetGridCell)
+	router.HandleFunc("/pose", s.HandlePose)
+	router.HandleFunc("/setOrigin", s.HandleSetOrigin)
+	router.HandleFunc("/map.json", s.HandleMapJSON)
+	router.HandleFunc("/map.png", s.HandleMapPNG)
+	router.HandleFunc("/map.pgm", s.HandleMapPGM)
+	router.HandleFunc("/map.yaml", s.HandleMapYAML)
+	router.HandleFunc("/clearMap", s.HandleClearMap)
+	router.HandleFunc("/saveMap/{name}", s.HandleSaveMap)
+	router.Handle("/events", s.events)
+
+	return router
+}
+
 func main() {
 
-	comPort = os.Args[1]
+	comPort := os.Args[1]
+	profilesPath := DefaultProfilesPath()
+	if len(os.Args) > 2 {
+		profilesPath = os.Args[2]
+	}
 
-	fmt.Println("Expecting to find board on ", comPort)
-	router := mux.NewRouter().StrictSlash(true)
+	profiles, err := LoadProfiles(profilesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Using calibration profiles in ", profilesPath)
+	// a profile named on the command line becomes the robot's profile
+	if len(os.Args) > 3 {
+		profiles.Use(comPort, os.Args[3])
+		if err := profiles.Save(); err != nil {
+			fmt.Println("Could not save calibration profiles - err ", err)
+		}
+	}
 
-	router.HandleFunc("/crossdomain.xml", HandleCrossDomainReq)
-	router.HandleFunc("/poll", HandlePoll)
-	router.HandleFunc("/reset_all", HandleReset)
-	router.HandleFunc("/readSonar/{id}", HandleReadSonar)
-	router.HandleFunc("/turnSonar/{id}/{dir}/{angle}", HandleTurnSonar)
-	router.HandleFunc("/centerSonar/{id}", HandleCenterSonar)
-	router.HandleFunc("/run/{dir}", HandleRun)
-	router.HandleFunc("/stop", HandleStop)
-	router.HandleFunc("/turn/{id}/{dir}/{angle}", HandleTurn)
-	router.HandleFunc("/turnCalibrate/{id}/{dir}/{angle}/{steps}", HandleTurnCalibrate)
-	router.HandleFunc("/reverseTurn/{id}/{dir}/{angle}", HandleReverseTurn)
-	router.HandleFunc("/step/{id}/{dir}/{steps}", HandleStep)
-	router.HandleFunc("/wheelStep/{id}/{which}/{dir}/{steps}", HandleWheelStep)
-	router.HandleFunc("/lightOn/{red}/{green}/{blue}", HandleLightOn)
-	router.HandleFunc("/lightColor/{color}", HandleLightColor)
-	router.HandleFunc("/lightOff", HandleLightOff)
-	router.HandleFunc("/playToneFor/{id}/{freq}/{delay}", HandlePlayToneFor)
-	router.HandleFunc("/playTone/{freq}", HandlePlayTone)
-	router.HandleFunc("/buzzerOff", HandleBuzzerOff)
-	router.HandleFunc("/beep", HandleBeep)
-	router.HandleFunc("/readLineSensor/{id}", HandleReadLineSensor)
+	fmt.Println("Expecting to find board on ", comPort)
+	server := CreateServer(comPort, profiles)
 
 	fmt.Println("Starting server ...")
-	lastCmdTime = time.Now()
-	log.Fatal(http.ListenAndServe(":45678", router))
+	log.Fatal(http.ListenAndServe(":45678", server.WatchClient(server.Router())))
 }
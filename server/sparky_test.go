@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T) *Server {
+	profiles, err := LoadProfiles(filepath.Join(t.TempDir(), "profiles.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := CreateServer("test", profiles)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestResetWhileDisconnected(t *testing.T) {
+	s := testServer(t)
+	s.mu.Lock()
+	s.pendingReqs["7"] = "7"
+	s.problems = []string{"Obstacle ahead, request 6 stopped"}
+	s.cliff, s.obstacleStop, s.orphaned = true, true, true
+	s.startTask("8", "test", func(t *Task) error {
+		return t.Sleep(time.Minute)
+	})
+	s.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest("GET", "/reset_all", nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pendingReqs) != 0 || len(s.problems) != 0 || s.task != nil {
+		t.Errorf("pending %v, problems %v, task %v left after reset", s.pendingReqs, s.problems, s.task)
+	}
+	if s.cliff || s.obstacleStop || s.orphaned {
+		t.Error("flags left set after reset")
+	}
+}
+
+func TestMonitorsOnlyWhileWatched(t *testing.T) {
+	s := testServer(t)
+	rover, _ := testRover(t, s.workResponseQueue, s.profiles.Get(DefaultProfile), s.odometry)
+	s.mu.Lock()
+	s.rover = rover
+	s.updateMonitors()
+	s.mu.Unlock()
+
+	get := func(path string) {
+		s.Router().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	monitoring := func() (sonar bool, line bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return rover.sonar.monitor.Running(), rover.lineSensor.Streaming()
+	}
+
+	if sonar, line := monitoring(); sonar || line {
+		t.Fatalf("monitoring sonar %t line %t before watching", sonar, line)
+	}
+	get("/watch/sonar/on")
+	if sonar, line := monitoring(); !sonar || line {
+		t.Errorf("monitoring sonar %t line %t watching the sonar", sonar, line)
+	}
+	get("/watch/line/on")
+	if sonar, line := monitoring(); !sonar || !line {
+		t.Errorf("monitoring sonar %t line %t watching both", sonar, line)
+	}
+	get("/reset_all")
+	if sonar, line := monitoring(); sonar || line {
+		t.Errorf("monitoring sonar %t line %t after reset", sonar, line)
+	}
+}
+
+func TestSpeedRoutes(t *testing.T) {
+	s := testServer(t)
+	rover, _ := testRover(t, s.workResponseQueue, s.profiles.Get(DefaultProfile), s.odometry)
+	s.mu.Lock()
+	s.rover = rover
+	s.mu.Unlock()
+
+	tests := []struct {
+		path    string
+		problem bool
+		state   string
+	}{
+		// a fractional speed runs at the nearest whole speed
+		{"/runSpeed/forward/50.5", false, MotionRunning},
+		{"/drive/-20.4/30", false, MotionRunning},
+		{"/curve/40.6/-10.5", false, MotionRunning},
+		// a bad speed leaves the rover stopped, not driving at zero
+		{"/runSpeed/forward/fast", true, MotionIdle},
+		{"/drive/20/NaN", true, MotionIdle},
+	}
+	for _, test := range tests {
+		s.Router().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stop", nil))
+		w := httptest.NewRecorder()
+		s.Router().ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if problem := strings.Contains(w.Body.String(), "_problem"); problem != test.problem {
+			t.Errorf("%s: answered %q, want a problem %t", test.path, w.Body.String(), test.problem)
+		}
+		if state, _ := rover.wheels.State(); state != test.state {
+			t.Errorf("%s: wheels %s, want %s", test.path, state, test.state)
+		}
+	}
+}
+
+func TestParseSpeed(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		ok    bool
+	}{
+		{"50", 50, true},
+		{"50.5", 51, true},
+		{"-20.4", -20, true},
+		{"250", 100, true},
+		{"-1e300", -100, true},
+		{"fast", 0, false},
+		{"", 0, false},
+		{"NaN", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseSpeed(test.value)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseSpeed(%q) = %d, %v, want %d ok %t", test.value, got, err, test.want, test.ok)
+		}
+	}
+}
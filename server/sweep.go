@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// SweepPoint is one range reading of a sonar sweep. Angle is the head angle
+// in degrees, positive to the right.
+type SweepPoint struct {
+	Angle int `json:"angle"`
+	Range int `json:"range"`
+}
+
+// SweepSonar turns the sonar head from one angle to another in steps of
+// step degrees and reads the range at each angle, ending at to even when
+// the steps fall short of it. Readings are recorded at the angle the head
+// actually turned to, and a turn the head's limits leave where it was is
+// not read again.
+func SweepSonar(t *Task, from int, to int, step int) ([]SweepPoint, error) {
+	var angles []int
+	for angle := from; angle < to; angle += step {
+		angles = append(angles, angle)
+	}
+	if from <= to {
+		angles = append(angles, to)
+	}
+
+	var points []SweepPoint
+	for _, angle := range angles {
+		turned, err := TurnSonarTo(t, angle)
+		if err != nil {
+			return points, err
+		}
+		if len(points) > 0 && points[len(points)-1].Angle == turned {
+			continue
+		}
+		value, err := ReadSonarRange(t)
+		if err != nil {
+			return points, err
+		}
+		points = append(points, SweepPoint{Angle: turned, Range: value})
+	}
+	return points, nil
+}
+
+// TurnSonarTo points the sonar head at angle, positive to the right, and
+// waits for the head to settle. It returns the angle the head turned to,
+// which the calibrated limits may keep short of angle.
+func TurnSonarTo(t *Task, angle int) (int, error) {
+	direction := "right"
+	if angle < 0 {
+		direction, angle = "left", -angle
+	}
+	resps, err := t.Call(func(r *Rover, id string) error {
+		return r.sonar.Turn(id, direction, angle)
+	}, 1, SonarTurnTime+RequestTimeoutMargin)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(resps[0].GetRespValue())
+}
+
+// ReadSonarRange reads the range in front of the sonar head.
+func ReadSonarRange(t *Task) (int, error) {
+	resps, err := t.Call(func(r *Rover, id string) error {
+		return r.sonar.ReadRange(id)
+	}, 1, SonarReadTime+RequestTimeoutMargin)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(resps[0].GetRespValue())
+}
+
+// ReadLines reads both line sensors, 1 meaning a line is under the sensor.
+func ReadLines(t *Task) (left int, right int, err error) {
+	resps, err := t.Call(func(r *Rover, id string) error {
+		return r.lineSensor.readLineSensors(id)
+	}, 2, RequestTimeoutMargin)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, resp := range resps {
+		value, _ := strconv.Atoi(resp.GetRespValue())
+		if resp.GetType() == LineLeftResp {
+			left = value
+		} else {
+			right = value
+		}
+	}
+	return left, right, nil
+}
+
+// SweepStep is the default angle between the readings of a sonar scan
+const SweepStep = 15
+
+// SweepResult is the range profile of a sonar scan, together with the
+// directions derived from it. Angles are in degrees, positive to the right.
+type SweepResult struct {
+	Time          time.Time    `json:"time"`
+	Step          int          `json:"step"`
+	Points        []SweepPoint `json:"points"`
+	NearestAngle  int          `json:"nearestAngle"`
+	NearestRange  int          `json:"nearestRange"`
+	ClearestAngle int          `json:"clearestAngle"`
+	ClearestRange int          `json:"clearestRange"`
+}
+
+// NewSweepResult derives the nearest obstacle and the clearest direction
+// from the readings of a scan. The clearest direction is the one whose
+// reading, together with its neighbours', is furthest, so that a single
+// reading through a narrow gap does not count as a way through. Ties go to
+// the direction closest to straight ahead.
+func NewSweepResult(points []SweepPoint, step int) *SweepResult {
+	result := &SweepResult{Time: time.Now(), Step: step, Points: points}
+	if len(points) == 0 {
+		return result
+	}
+
+	nearest, clearest, clearestRange := 0, 0, -1
+	for i, p := range points {
+		if p.Range < points[nearest].Range {
+			nearest = i
+		}
+		open := p.Range
+		if i > 0 && points[i-1].Range < open {
+			open = points[i-1].Range
+		}
+		if i < len(points)-1 && points[i+1].Range < open {
+			open = points[i+1].Range
+		}
+		if open > clearestRange || open == clearestRange && abs(p.Angle) < abs(points[clearest].Angle) {
+			clearest, clearestRange = i, open
+		}
+	}
+	result.NearestAngle, result.NearestRange = points[nearest].Angle, points[nearest].Range
+	result.ClearestAngle, result.ClearestRange = points[clearest].Angle, clearestRange
+	return result
+}
+
+// WriteReporters writes the derived directions as poll lines.
+func (sr *SweepResult) WriteReporters(w io.Writer) {
+	fmt.Fprintf(w, "nearestObstacleAngle %d\n", sr.NearestAngle)
+	fmt.Fprintf(w, "nearestObstacleRange %d\n", sr.NearestRange)
+	fmt.Fprintf(w, "clearestDirection %d\n", sr.ClearestAngle)
+}
+
+// ScanSonar sweeps the sonar head across its whole range, up to 90 degrees
+// either side, and keeps the profile as the server's last scan. The head is
+// centred again afterwards.
+func (s *Server) ScanSonar(t *Task, step int) (*SweepResult, error) {
+	s.mu.Lock()
+	from, to := -s.rover.calibration.SonarLeftLimit, s.rover.calibration.SonarRightLimit
+	s.mu.Unlock()
+	if from < -90 {
+		from = -90
+	}
+	if to > 90 {
+		to = 90
+	}
+
+	points, err := SweepSonar(t, from, to, step)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := TurnSonarTo(t, 0); err != nil {
+		return nil, err
+	}
+
+	result := NewSweepResult(points, step)
+	fmt.Println("Sonar scan: nearest ", result.NearestRange, " cm at ", result.NearestAngle, " clearest at ", result.ClearestAngle)
+
+	s.mu.Lock()
+	s.sweep = result
+	s.mu.Unlock()
+	s.events.Publish("sweep", result)
+	return result, nil
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
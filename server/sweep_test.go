@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sparkybots/sparky/server/board"
+	"reflect"
+	"testing"
+)
+
+// answerSonar answers the sonar turns and readings written to conn, as the
+// firmware would, until done is closed. Every reading is rangeCm.
+func answerSonar(sonar *Sonar, conn *fakeConn, rangeCm uint8, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		conn.mutex.Lock()
+		written := conn.written
+		conn.written = nil
+		conn.mutex.Unlock()
+		for _, msg := range written {
+			if bytes.HasPrefix(msg, []byte{board.StartSysex, board.RoverSonar, board.SonarTurn}) {
+				sonar.processTurnDone(nil)
+			} else if bytes.HasPrefix(msg, []byte{board.StartSysex, board.RoverSonar, board.SonarRead}) {
+				sonar.processRangeResponse(rangeCm)
+			}
+		}
+	}
+}
+
+func TestSweepSonar(t *testing.T) {
+	tests := []struct {
+		name       string
+		rightLimit int
+		angles     []int
+	}{
+		// the steps fall short of the end of the sweep
+		{"within limits", 90, []int{-60, -35, -10, 15, 40, 60}},
+		{"end beyond the limit", 50, []int{-60, -35, -10, 15, 40, 50}},
+		// turns the limit stops short are only read once
+		{"steps beyond the limit", 30, []int{-60, -35, -10, 15, 30}},
+	}
+	for _, test := range tests {
+		s := testServer(t)
+		cal := DefaultCalibration()
+		cal.SonarRightLimit = test.rightLimit
+		rover, conn := testRover(t, s.workResponseQueue, cal, s.odometry)
+		s.mu.Lock()
+		s.rover = rover
+		s.mu.Unlock()
+
+		done := make(chan struct{})
+		go answerSonar(rover.sonar, conn, 42, done)
+		task := &Task{server: s, name: "sweep", stop: make(chan struct{})}
+		points, err := SweepSonar(task, -60, 60, 25)
+		close(done)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var angles []int
+		for _, p := range points {
+			angles = append(angles, p.Angle)
+			if p.Range != 42 {
+				t.Errorf("%s: range %d at %d, want 42", test.name, p.Range, p.Angle)
+			}
+		}
+		if !reflect.DeepEqual(angles, test.angles) {
+			t.Errorf("%s: read at %v, want %v", test.name, angles, test.angles)
+		}
+	}
+}
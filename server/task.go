@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrTaskStopped = errors.New("Task was stopped")
+
+// Task is a long running routine on the server, such as a calibration,
+// that drives the rover itself. It issues commands under internal request
+// IDs and waits for the board to answer them. A task started from Scratch
+// keeps the block's ID pending until it finishes.
+type Task struct {
+	server   *Server
+	name     string
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Call is a command issued by a task whose responses have not all been
+// collected yet.
+type Call struct {
+	task      *Task
+	id        string
+	count     int
+	responses chan Work
+}
+
+// Stop asks the task to finish. Calls waiting on the board return
+// ErrTaskStopped.
+func (t *Task) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+func (t *Task) Stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sleep waits for d, returning ErrTaskStopped if the task is stopped first.
+func (t *Task) Sleep(d time.Duration) error {
+	select {
+	case <-t.stop:
+		return ErrTaskStopped
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// Issue sends a rover command under a new internal ID. count is the number
+// of responses the command produces.
+func (t *Task) Issue(command func(r *Rover, id string) error, count int) (*Call, error) {
+	if t.Stopped() {
+		return nil, ErrTaskStopped
+	}
+	id, responses, err := t.server.issue(command, count)
+	if err != nil {
+		return nil, err
+	}
+	return &Call{task: t, id: id, count: count, responses: responses}, nil
+}
+
+// Do sends a rover command that the board does not answer.
+func (t *Task) Do(command func(r *Rover) error) error {
+	_, err := t.Call(func(r *Rover, id string) error {
+		return command(r)
+	}, 0, 0)
+	return err
+}
+
+// Call issues a command and waits up to timeout for its responses.
+func (t *Task) Call(command func(r *Rover, id string) error, count int, timeout time.Duration) ([]Work, error) {
+	call, err := t.Issue(command, count)
+	if err != nil {
+		return nil, err
+	}
+	return call.Wait(timeout)
+}
+
+// Done reports whether all responses to the call have arrived, without
+// waiting.
+func (c *Call) Done() bool {
+	return len(c.responses) == c.count
+}
+
+// Wait collects the responses to the call, giving up after timeout.
+func (c *Call) Wait(timeout time.Duration) (resps []Work, err error) {
+	defer c.task.server.unregister(c.id)
+
+	deadline := time.After(timeout)
+	for len(resps) < c.count {
+		select {
+		case resp := <-c.responses:
+			resps = append(resps, resp)
+		case <-c.task.stop:
+			return resps, ErrTaskStopped
+		case <-deadline:
+			return resps, fmt.Errorf("%s: request %s timed out", c.task.name, c.id)
+		}
+	}
+	return resps, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	TrajectoryTask = "trajectory"
+
+	// DefaultTrajectorySpeed is the cruising speed towards waypoints, in cm
+	// per second
+	DefaultTrajectorySpeed = 10
+	// WaypointInterval is how often the steering towards a waypoint is
+	// updated
+	WaypointInterval = 100 * time.Millisecond
+	// WaypointTolerance is how close, in cm, the rover has to come to a
+	// waypoint to have reached it
+	WaypointTolerance = 3
+	// WaypointTurnGain is the turn rate, in degrees per second, for every
+	// degree the waypoint is off the heading, up to WaypointMaxTurnRate
+	WaypointTurnGain    = 2
+	WaypointMaxTurnRate = 90
+	// WaypointSpinAngle is how far off the heading, in degrees, a waypoint
+	// has to be for the rover to turn on the spot towards it
+	WaypointSpinAngle = 60
+)
+
+// Segment is a stretch of a trajectory driven at constant speeds, in the
+// units of a Motion: Speed in cm per second, negative when backing up, and
+// TurnRate in degrees per second clockwise. Duration is in seconds.
+type Segment struct {
+	Speed    float64 `json:"speed"`
+	TurnRate float64 `json:"turnRate"`
+	Duration float64 `json:"duration"`
+}
+
+// Waypoint is a point in the pose's frame, in cm.
+type Waypoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Trajectory is a path for the rover, given either as segments or as
+// waypoints. It is driven without stopping between them.
+type Trajectory struct {
+	Segments  []Segment  `json:"segments,omitempty"`
+	Waypoints []Waypoint `json:"waypoints,omitempty"`
+	// Speed is the cruising speed towards waypoints, in cm per second
+	Speed float64 `json:"speed"`
+}
+
+func NewTrajectory() Trajectory {
+	return Trajectory{Speed: DefaultTrajectorySpeed}
+}
+
+// Validate checks that the trajectory can be driven.
+func (tr Trajectory) Validate() error {
+	switch {
+	case len(tr.Segments) > 0 && len(tr.Waypoints) > 0:
+		return fmt.Errorf("Trajectory has both segments and waypoints")
+	case len(tr.Segments) == 0 && len(tr.Waypoints) == 0:
+		return fmt.Errorf("Trajectory is empty")
+	case len(tr.Waypoints) > 0 && tr.Speed <= 0:
+		return fmt.Errorf("Invalid trajectory speed %v", tr.Speed)
+	}
+	for i, seg := range tr.Segments {
+		if seg.Duration <= 0 {
+			return fmt.Errorf("Invalid duration %v of segment %d", seg.Duration, i+1)
+		}
+	}
+	return nil
+}
+
+// Len is the number of segments or waypoints.
+func (tr Trajectory) Len() int {
+	return len(tr.Segments) + len(tr.Waypoints)
+}
+
+// DriveTrajectory drives the segments or waypoints one after the other and
+// stops at the end. The start and end of each is published as a trajectory
+// event, counting from 1.
+func (s *Server) DriveTrajectory(t *Task, tr Trajectory) (err error) {
+	defer func() {
+		s.setTrajectorySegment(0)
+		if err != nil && err != ErrTaskStopped {
+			s.stopWheels()
+		}
+	}()
+
+	for i := 0; i < tr.Len(); i++ {
+		s.setTrajectorySegment(i + 1)
+		s.publishSegment(i+1, tr.Len(), "started")
+		if i < len(tr.Segments) {
+			err = s.driveSegment(t, tr.Segments[i])
+		} else {
+			err = s.driveToWaypoint(t, tr.Waypoints[i-len(tr.Segments)], tr.Speed)
+		}
+		if err != nil {
+			return err
+		}
+		s.publishSegment(i+1, tr.Len(), "done")
+	}
+	return t.Do(func(r *Rover) error {
+		return r.wheels.Stop()
+	})
+}
+
+// driveSegment sets the wheel speeds of a segment and leaves them running
+// for its duration, so that the next segment follows on without a stop.
+func (s *Server) driveSegment(t *Task, seg Segment) error {
+	if err := t.Do(func(r *Rover) error {
+		return r.wheels.DriveVelocity(seg.Speed, seg.TurnRate)
+	}); err != nil {
+		return err
+	}
+	return t.Sleep(time.Duration(seg.Duration * float64(time.Second)))
+}
+
+// driveToWaypoint steers towards a waypoint by the odometry pose, curving
+// towards it and turning on the spot first when it is well off the
+// heading. The rover slows down as far as the waypoint is off the heading.
+func (s *Server) driveToWaypoint(t *Task, wp Waypoint, speed float64) error {
+	for {
+		pose := s.odometry.Pose()
+		dx, dy := wp.X-pose.X, wp.Y-pose.Y
+		if math.Hypot(dx, dy) < WaypointTolerance {
+			return nil
+		}
+
+		bearing := normalizeAngle(math.Atan2(dx, dy)*180/math.Pi - pose.Heading)
+		turnRate := math.Max(-WaypointMaxTurnRate, math.Min(WaypointMaxTurnRate, WaypointTurnGain*bearing))
+		forward := 0.0
+		if math.Abs(bearing) < WaypointSpinAngle {
+			forward = speed * math.Cos(bearing*math.Pi/180)
+		}
+		if err := t.Do(func(r *Rover) error {
+			return r.wheels.DriveVelocity(forward, turnRate)
+		}); err != nil {
+			return err
+		}
+		if err := t.Sleep(WaypointInterval); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) setTrajectorySegment(segment int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trajectorySegment = segment
+}
+
+func (s *Server) publishSegment(segment int, count int, state string) {
+	fmt.Println("Trajectory: segment ", segment, " of ", count, " ", state)
+	s.events.Publish("trajectory", map[string]interface{}{
+		"segment": segment,
+		"count":   count,
+		"state":   state,
+		"pose":    s.odometry.Pose(),
+	})
+}
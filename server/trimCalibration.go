@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Trim calibration drives the rover straight towards a wall and measures,
+// with sonar sweeps before and after, how far its heading drifted. The
+// drift tells how much further one wheel went than the other.
+const (
+	// TrimSweepAngle is how far either side of centre the wall is looked for
+	TrimSweepAngle = 30
+	TrimSweepStep  = 5
+	// the drive ends this close to the wall, or when a line sensor finds the
+	// tape line laid in front of it, or after TrimMaxDistance
+	TrimStopRange   = 25
+	TrimMaxDistance = 100
+	// TrimMinDistance is the shortest drive a drift can be measured over
+	TrimMinDistance = 20
+)
+
+// CalibrateTrim sets the wheel trim of the robot's calibration profile from
+// a drive towards a wall the rover was placed square to.
+func (s *Server) CalibrateTrim(t *Task) error {
+	before, err := wallAngle(t)
+	if err != nil {
+		return err
+	}
+	if _, err := TurnSonarTo(t, 0); err != nil {
+		return err
+	}
+	start, err := ReadSonarRange(t)
+	if err != nil {
+		return err
+	}
+	if start < TrimStopRange+TrimMinDistance {
+		return fmt.Errorf("Trim calibration: wall too close (%d cm)", start)
+	}
+
+	if err := t.Do(func(r *Rover) error {
+		return r.wheels.RunDefault("forward")
+	}); err != nil {
+		return err
+	}
+	end, err := driveToWall(t, start)
+	if stopErr := t.Do(func(r *Rover) error {
+		return r.wheels.Stop()
+	}); err == nil {
+		err = stopErr
+	}
+	if err != nil {
+		return err
+	}
+
+	after, err := wallAngle(t)
+	if err != nil {
+		return err
+	}
+	distance := float64(start - end)
+	if distance < TrimMinDistance {
+		return fmt.Errorf("Trim calibration: drove only %.0f cm", distance)
+	}
+
+	// the rover turning right makes the wall appear further left
+	drift := (before - after) * math.Pi / 180
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cal := s.rover.calibration
+	left, right := wheelDistances(cal, distance, drift)
+	if left > right {
+		cal.LeftTrim *= right / left
+	} else {
+		cal.RightTrim *= left / right
+	}
+	fmt.Println("Trim calibration: drove ", distance, " cm, drifted ", drift*180/math.Pi, " degrees, trim ", cal.LeftTrim, cal.RightTrim)
+	s.saveProfiles()
+	return s.rover.wheels.ApplyTrim()
+}
+
+// driveToWall waits while the rover runs until it is close to the wall or
+// finds a line, and returns the last range.
+func driveToWall(t *Task, start int) (int, error) {
+	for {
+		value, err := ReadSonarRange(t)
+		if err != nil {
+			return 0, err
+		}
+		left, right, err := ReadLines(t)
+		if err != nil {
+			return 0, err
+		}
+		if value <= TrimStopRange || left == 1 || right == 1 || start-value >= TrimMaxDistance {
+			return value, nil
+		}
+	}
+}
+
+// wallAngle sweeps the sonar and returns the head angle at which the wall is
+// closest, interpolated between the readings around the minimum.
+func wallAngle(t *Task) (float64, error) {
+	points, err := SweepSonar(t, -TrimSweepAngle, TrimSweepAngle, TrimSweepStep)
+	if err != nil {
+		return 0, err
+	}
+
+	best := 0
+	for i, p := range points {
+		if p.Range < points[best].Range {
+			best = i
+		}
+	}
+	if best == 0 || best == len(points)-1 {
+		return 0, fmt.Errorf("Trim calibration: no wall in front of the rover")
+	}
+
+	// vertex of the parabola through the minimum and its neighbours
+	a, b, c := float64(points[best-1].Range), float64(points[best].Range), float64(points[best+1].Range)
+	offset := 0.0
+	if denom := a - 2*b + c; denom != 0 {
+		offset = 0.5 * (a - c) / denom
+	}
+	return float64(points[best].Angle) + offset*TrimSweepStep, nil
+}
+
+// wheelDistances splits a drive of distance cm during which the heading
+// changed by drift radians, positive to the right, into the distance of
+// each wheel.
+func wheelDistances(cal *Calibration, distance float64, drift float64) (left float64, right float64) {
+	base := cal.WheelBase()
+	return distance + drift*base/2, distance - drift*base/2
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Turn calibration spins the rover in front of a wall while it samples the
+// sonar. The range is shortest each time the sonar faces the wall, so the
+// time between two minima is the time of a full revolution.
+const (
+	// CalibrationRevolutions is how many turns the rover makes, at its
+	// current calibration, in each direction
+	CalibrationRevolutions = 2.5
+	// CalibrationDipLevel is where, between the closest and furthest range,
+	// a sample stops counting as facing the wall
+	CalibrationDipLevel = 0.3
+)
+
+type rangeSample struct {
+	at    time.Duration
+	value int
+}
+
+// CalibrateTurn measures the turn rate in mode for both directions and
+// stores it in the robot's calibration profile.
+func (s *Server) CalibrateTurn(t *Task, mode string) error {
+	if _, err := TurnSonarTo(t, 0); err != nil {
+		return err
+	}
+
+	for _, direction := range []string{"right", "left"} {
+		s.mu.Lock()
+		expected := float64(s.rover.calibration.MillisForAngle(360, direction, mode))
+		s.mu.Unlock()
+
+		millis := int(expected * CalibrationRevolutions)
+		if millis > MaxChunk {
+			millis = MaxChunk
+		}
+		samples, err := sampleTurn(t, direction, mode, millis)
+		if err != nil {
+			return err
+		}
+		period, err := turnPeriod(samples, time.Duration(expected)*time.Millisecond)
+		if err != nil {
+			return fmt.Errorf("Turn calibration %s: %s", direction, err)
+		}
+
+		rate := 360 / (float64(period) / float64(time.Millisecond))
+		fmt.Println("Turn calibration ", direction, mode, " revolution ", period, " degrees per ms ", rate)
+
+		s.mu.Lock()
+		field := direction + "DegreesPerMilli"
+		if mode == TurnSpin {
+			field = direction + "SpinDegreesPerMilli"
+		}
+		s.rover.calibration.Set(field, rate)
+		s.saveProfiles()
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// sampleTurn turns for millis milliseconds while reading the sonar as fast
+// as the board answers.
+func sampleTurn(t *Task, direction string, mode string, millis int) ([]rangeSample, error) {
+	turn, err := t.Issue(func(r *Rover, id string) error {
+		return r.wheels.Turn(id, direction, mode, 1, millis)
+	}, 1)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+
+	var samples []rangeSample
+	for !turn.Done() {
+		value, err := ReadSonarRange(t)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, rangeSample{at: time.Since(start), value: value})
+	}
+	if _, err := turn.Wait(RequestTimeoutMargin); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// turnPeriod finds the dips in the range samples and returns the mean time
+// between them. Dips closer than half the expected period are taken to be
+// the same one.
+func turnPeriod(samples []rangeSample, expected time.Duration) (time.Duration, error) {
+	if len(samples) < 10 {
+		return 0, fmt.Errorf("too few sonar readings (%d)", len(samples))
+	}
+
+	// a median of three removes single missed echoes
+	smooth := make([]int, len(samples))
+	for i := range samples {
+		window := []int{samples[i].value}
+		if i > 0 {
+			window = append(window, samples[i-1].value)
+		}
+		if i < len(samples)-1 {
+			window = append(window, samples[i+1].value)
+		}
+		sort.Ints(window)
+		smooth[i] = window[len(window)/2]
+	}
+
+	lo, hi := smooth[0], smooth[0]
+	for _, v := range smooth {
+		lo, hi = int(math.Min(float64(lo), float64(v))), int(math.Max(float64(hi), float64(v)))
+	}
+	if hi-lo < 10 {
+		return 0, fmt.Errorf("no wall in sight (range %d to %d cm)", lo, hi)
+	}
+	level := lo + int(float64(hi-lo)*CalibrationDipLevel)
+
+	// the time of each dip is the middle of its closest readings
+	var dips []time.Duration
+	for i := 0; i < len(smooth); {
+		if smooth[i] > level {
+			i++
+			continue
+		}
+		best, first, last := smooth[i], i, i
+		for ; i < len(smooth) && smooth[i] <= level; i++ {
+			if smooth[i] < best {
+				best, first, last = smooth[i], i, i
+			} else if smooth[i] == best {
+				last = i
+			}
+		}
+		at := (samples[first].at + samples[last].at) / 2
+		if n := len(dips); n > 0 && at-dips[n-1] < expected/2 {
+			continue
+		}
+		dips = append(dips, at)
+	}
+	if len(dips) < 2 {
+		return 0, fmt.Errorf("found %d distance minima, need at least 2", len(dips))
+	}
+
+	period := (dips[len(dips)-1] - dips[0]) / time.Duration(len(dips)-1)
+	if period < expected/3 || period > expected*3 {
+		return 0, fmt.Errorf("revolution of %s is implausible", period)
+	}
+	return period, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// revolutionSamples returns sonar readings every 50ms of a rover turning in
+// front of a wall once every period, with every missed echo reading as the
+// maximum range.
+func revolutionSamples(period time.Duration, total time.Duration, missed map[int]bool) []rangeSample {
+	var samples []rangeSample
+	for i := 0; time.Duration(i)*50*time.Millisecond < total; i++ {
+		at := time.Duration(i) * 50 * time.Millisecond
+		phase := 2 * math.Pi * at.Seconds() / period.Seconds()
+		value := 30 + int(70*(1-math.Cos(phase))/2)
+		if missed[i] {
+			value = SonarMaxRange
+		}
+		samples = append(samples, rangeSample{at: at, value: value})
+	}
+	return samples
+}
+
+func TestTurnPeriod(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []rangeSample
+		expected time.Duration
+		ok       bool
+	}{
+		{"clean", revolutionSamples(2*time.Second, 5*time.Second, nil), 2 * time.Second, true},
+		{"slower than expected", revolutionSamples(2*time.Second, 5*time.Second, nil), 1500 * time.Millisecond, true},
+		{"missed echoes", revolutionSamples(2*time.Second, 5*time.Second, map[int]bool{1: true, 40: true}), 2 * time.Second, true},
+		{"one revolution", revolutionSamples(2*time.Second, 1500*time.Millisecond, nil), 2 * time.Second, false},
+		{"too few readings", revolutionSamples(2*time.Second, 400*time.Millisecond, nil), 2 * time.Second, false},
+		{"implausible", revolutionSamples(2*time.Second, 5*time.Second, nil), 600 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		period, err := turnPeriod(test.samples, test.expected)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err %v, want ok %t", test.name, err, test.ok)
+			continue
+		}
+		if test.ok && (period < 1950*time.Millisecond || period > 2050*time.Millisecond) {
+			t.Errorf("%s: period %s, want 2s", test.name, period)
+		}
+	}
+}
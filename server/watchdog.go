@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultClientTimeout is how long the client may stay silent before
+	// the rover is stopped, unless a project sets another timeout or turns
+	// the watchdog off
+	DefaultClientTimeout = 3 * time.Second
+	// WatchdogInterval is how often the watchdog looks at the client
+	WatchdogInterval = 250 * time.Millisecond
+)
+
+// WatchClient wraps the server's routes so that every request, polls and
+// commands alike, tells the watchdog that the client is still there.
+func (s *Server) WatchClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.lastClientTime, s.silent = time.Now(), false
+		s.mu.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkClient is the dead-man switch. Scratch polls many times a second, so
+// a client that stays silent for the client timeout has crashed or gone to
+// sleep, and whatever it left running is stopped: the wheels, the task and
+// the buzzer. The requests it was waiting on fail, and the session stays
+// orphaned until the next motion command.
+func (s *Server) checkClient() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clientTimeout <= 0 || s.silent || !s.rover.Connected() || time.Since(s.lastClientTime) < s.clientTimeout {
+		return
+	}
+
+	fmt.Println("Client silent for ", time.Since(s.lastClientTime), ", orphaning session")
+	s.silent, s.orphaned = true, true
+	s.abortMotion("Client went silent")
+	s.rover.buzzer.FlushRequests()
+	if err := s.rover.buzzer.BuzzerOff(); err != nil {
+		fmt.Println("Could not turn buzzer off - err ", err)
+	}
+	for id := range s.pendingReqs {
+		delete(s.pendingReqs, id)
+		s.problems = append(s.problems, fmt.Sprintf("Client went silent, request %s stopped", id))
+	}
+	s.events.Publish("orphaned", s.odometry.Pose())
+}
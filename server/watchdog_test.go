@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/sparkybots/sparky/server/board"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckClientStopsRover(t *testing.T) {
+	profiles, err := LoadProfiles(filepath.Join(t.TempDir(), "profiles.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := CreateServer("test", profiles)
+	defer s.Close()
+	rover, conn := testRover(t, s.workResponseQueue, profiles.Get(DefaultProfile), s.odometry)
+	s.mu.Lock()
+	s.rover = rover
+	s.mu.Unlock()
+	router := s.Router()
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Body.String()
+	}
+
+	get("/driveDistance/7/forward/30")
+	if steps := conn.commands(board.RoverMove, board.MoveStep); len(steps) != 1 {
+		t.Fatalf("sent %d steps, want 1", len(steps))
+	}
+	if poll := get("/poll"); !strings.Contains(poll, "_busy  7") {
+		t.Fatalf("request 7 not busy in poll:\n%s", poll)
+	}
+
+	// the client stops polling
+	s.mu.Lock()
+	s.lastClientTime = time.Now().Add(-DefaultClientTimeout - time.Second)
+	s.mu.Unlock()
+	s.checkClient()
+
+	if stops := conn.commands(board.RoverMove, board.MoveStop); len(stops) == 0 {
+		t.Error("wheels not stopped")
+	}
+	if s.odometry.Moving() {
+		t.Error("odometry still moving")
+	}
+	poll := get("/poll")
+	for _, line := range []string{"_problem Client went silent, request 7 stopped", "orphaned true"} {
+		if !strings.Contains(poll, line) {
+			t.Errorf("poll lacks %q:\n%s", line, poll)
+		}
+	}
+	if strings.Contains(poll, "_busy") {
+		t.Errorf("requests still busy:\n%s", poll)
+	}
+}
+
+func TestCheckClientOff(t *testing.T) {
+	profiles, err := LoadProfiles(filepath.Join(t.TempDir(), "profiles.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := CreateServer("test", profiles)
+	defer s.Close()
+	rover, conn := testRover(t, s.workResponseQueue, profiles.Get(DefaultProfile), s.odometry)
+	s.mu.Lock()
+	s.rover = rover
+	s.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest("GET", "/clientTimeout/0", nil))
+	s.mu.Lock()
+	s.lastClientTime = time.Now().Add(-time.Minute)
+	s.mu.Unlock()
+	s.checkClient()
+
+	s.mu.Lock()
+	orphaned := s.orphaned
+	s.mu.Unlock()
+	if stops := conn.commands(board.RoverMove, board.MoveStop); len(stops) != 0 || orphaned {
+		t.Error("rover stopped with the watchdog off")
+	}
+}
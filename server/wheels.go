@@ -4,25 +4,59 @@ import (
 	"fmt"
 	"github.com/sparkybots/gobot"
 	"github.com/sparkybots/sparky/server/board"
+	"math"
 	"strconv"
+	"time"
 )
 
 const (
 	WheelsTurnReq string = "TURN"
 	WheelsStepReq string = "STEP"
+
+	// TurnPivot turns around the inner wheel, TurnSpin turns on the spot
+	// with the wheels running in opposite directions
+	TurnPivot string = "pivot"
+	TurnSpin  string = "spin"
+
+	// StepTime is how long the firmware drives the wheels for each step
+	StepTime = 60 * time.Millisecond
+
+	// MaxPWM is the PWM duty of a wheel running at 100% speed
+	MaxPWM int = 255
+	// DefaultPWM is the firmware's wheel PWM duty for steps and turns
+	DefaultPWM int = 200
+
+	// RampInterval is how often the wheel speeds change while they speed up
+	// or slow down
+	RampInterval = 50 * time.Millisecond
+
+	// MaxChunk is the largest step count or turn time the firmware takes in
+	// one command. Longer motions are sent in several chunks.
+	MaxChunk int = 0x3FFF
 )
 
 type Wheels struct {
 	board        *board.Board
-	turnReqQueue chan WheelsReq
-	stepReqQueue chan WheelsReq
+	turnReqQueue *RequestQueue
+	stepReqQueue *RequestQueue
 	respQueue    chan Work
+	calibration  *Calibration
+	odometry     *Odometry
+	motion       *MotionQueue
 }
 
 type WheelsReq struct {
 	ID      string
 	ReqType string
 	Result  int
+
+	// seq is the number of the motion the request started
+	seq int
+	// remaining is the part of a chunked motion still to be sent, in the
+	// unit taken by send
+	remaining int
+	unit      time.Duration
+	send      func(amount int) error
 }
 
 func (r WheelsReq) GetID() string {
@@ -37,13 +71,16 @@ func (r WheelsReq) GetRespValue() string {
 	return strconv.Itoa(r.Result)
 }
 
-func CreateWheels(b *board.Board, respQ chan Work) Wheels {
+func CreateWheels(b *board.Board, respQ chan Work, cal *Calibration, odometry *Odometry) *Wheels {
 
-	Wheels := Wheels{
+	Wheels := &Wheels{
 		board:        b,
-		turnReqQueue: make(chan WheelsReq, 100),
-		stepReqQueue: make(chan WheelsReq, 100),
+		turnReqQueue: NewRequestQueue(),
+		stepReqQueue: NewRequestQueue(),
 		respQueue:    respQ,
+		calibration:  cal,
+		odometry:     odometry,
+		motion:       NewMotionQueue(),
 	}
 
 	gobot.On(b.Event("RoverTurnDone"), Wheels.processTurnDone)
@@ -51,117 +88,512 @@ func CreateWheels(b *board.Board, respQ chan Work) Wheels {
 	return Wheels
 }
 
-func (wh *Wheels) Turn(id string, direction string, angle int, steps int) (err error) {
+// Turn turns right or left by angle degrees, given the milliseconds per
+// degree in steps. mode is TurnPivot or TurnSpin.
+func (wh *Wheels) Turn(id string, direction string, mode string, angle int, steps int) error {
+	return wh.turn(id, direction, board.MoveDirFwd, mode, angle*steps)
+}
+
+// ReverseTurn pivots backward around the wheel on the side of direction.
+func (wh *Wheels) ReverseTurn(id string, direction string, angle int, steps int) error {
+	return wh.turn(id, direction, board.MoveDirRev, TurnPivot, angle*steps)
+}
 
-	req := WheelsReq{ID: id, ReqType: WheelsTurnReq, Result: 0}
+func (wh *Wheels) processTurnDone(data interface{}) {
+	wh.motionDone(wh.turnReqQueue, "turn")
+}
 
-	if direction == "left" {
-		err = wh.board.RoverTurn(board.TurnLeft, board.MoveDirFwd, byte(angle), steps)
-	} else {
-		err = wh.board.RoverTurn(board.TurnRight, board.MoveDirFwd, byte(angle), steps)
+// Step drives steps firmware steps forward or backward. Counts beyond what
+// the firmware takes at once are sent in chunks.
+func (wh *Wheels) Step(id string, direction string, steps int) error {
+	return wh.driveSteps(id, direction, steps)
+}
+
+// WheelStep drives only the left or right wheel by steps firmware steps.
+func (wh *Wheels) WheelStep(id string, which string, direction string, steps int) error {
+	side, left, right := board.MoveStepRight, 0, DefaultPWM
+	switch which {
+	case "right":
+	case "left":
+		side, left, right = board.MoveStepLeft, DefaultPWM, 0
+	default:
+		return fmt.Errorf("Unknown wheel %s for step request id %s", which, id)
+	}
+	dir := board.MoveDirFwd
+	if direction != "forward" {
+		dir, left, right = board.MoveDirRev, -left, -right
 	}
 
-	if err == nil {
-		fmt.Println("Wheels: sent turn request id : ", id)
-		wh.turnReqQueue <- req
-	} else {
-		wh.respQueue <- req
-		err = fmt.Errorf("Error sending turn request to board id %s err - %s ", id, err)
+	req := WheelsReq{ID: id, ReqType: WheelsStepReq, Result: 0, remaining: steps, unit: StepTime}
+	req.send = func(amount int) error {
+		return wh.board.RoverWheelStep(side, dir, amount)
+	}
+	return wh.submit(req, MotionStepping, func(req WheelsReq) error {
+		if err := wh.sendChunk(wh.stepReqQueue, req); err != nil {
+			return fmt.Errorf("Error sending step request to board id %s err - %s ", id, err)
+		}
+		wh.odometry.Move(wh.wheelMotion(left, right, time.Duration(steps)*StepTime))
+		fmt.Println("Wheels: sent step request id : ", id, " wheel : ", which, " steps : ", steps)
+		return nil
+	})
+}
+
+func (wh *Wheels) processStepDone(data interface{}) {
+	wh.motionDone(wh.stepReqQueue, "step")
+}
+
+// DriveDistance drives cm centimetres forward or backward.
+func (wh *Wheels) DriveDistance(id string, direction string, cm float64) error {
+	if cm < 0 {
+		direction, cm = reverse(direction), -cm
+	}
+	return wh.driveSteps(id, direction, wh.calibration.StepsForDistance(cm))
+}
+
+// DriveFor drives forward or backward for the given number of seconds.
+func (wh *Wheels) DriveFor(id string, direction string, seconds float64) error {
+	if seconds < 0 {
+		direction, seconds = reverse(direction), -seconds
 	}
+	return wh.driveSteps(id, direction, wh.calibration.StepsForDuration(time.Duration(seconds*float64(time.Second))))
+}
 
-	return
+func (wh *Wheels) driveSteps(id string, direction string, steps int) error {
+	dir, pwm := board.MoveDirFwd, DefaultPWM
+	if direction != "forward" {
+		dir, pwm = board.MoveDirRev, -pwm
+	}
+	req := WheelsReq{ID: id, ReqType: WheelsStepReq, Result: 0, remaining: steps, unit: StepTime}
+	req.send = func(amount int) error {
+		return wh.board.RoverStep(dir, amount)
+	}
+	return wh.submit(req, MotionStepping, func(req WheelsReq) error {
+		if err := wh.sendChunk(wh.stepReqQueue, req); err != nil {
+			return fmt.Errorf("Error sending step request to board id %s err - %s ", id, err)
+		}
+		wh.odometry.Move(wh.wheelMotion(pwm, pwm, time.Duration(steps)*StepTime))
+		fmt.Println("Wheels: sent drive request id : ", id, " steps : ", steps)
+		return nil
+	})
 }
 
-func (wh *Wheels) ReverseTurn(id string, direction string, angle int, steps int) (err error) {
+// TurnAngle turns right or left by degrees, timed by the calibrated turn
+// rate of mode.
+func (wh *Wheels) TurnAngle(id string, direction string, mode string, degrees float64) error {
+	if degrees < 0 {
+		direction, degrees = reverse(direction), -degrees
+	}
+	return wh.turn(id, direction, board.MoveDirFwd, mode, wh.calibration.MillisForAngle(degrees, direction, mode))
+}
 
-	req := WheelsReq{ID: id, ReqType: WheelsTurnReq, Result: 0}
+// reverse returns the opposite of a drive or turn direction, so that negative
+// amounts move the other way.
+func reverse(direction string) string {
+	switch direction {
+	case "forward":
+		return "backward"
+	case "left":
+		return "right"
+	case "right":
+		return "left"
+	default:
+		return "forward"
+	}
+}
 
+// turn runs the wheels for millis milliseconds. The firmware times a turn as
+// angle times steps, so the turn is sent with an angle of one and the
+// duration as steps, which leaves the length of a turn limited only by
+// chunking.
+func (wh *Wheels) turn(id string, direction string, dir byte, mode string, millis int) error {
+	side := board.TurnRight
 	if direction == "left" {
-		err = wh.board.RoverTurn(board.TurnLeft, board.MoveDirRev, byte(angle), steps)
-	} else {
-		err = wh.board.RoverTurn(board.TurnRight, board.MoveDirRev, byte(angle), steps)
+		side = board.TurnLeft
+	}
+	turnMode := board.TurnModePivot
+	if mode == TurnSpin {
+		turnMode = board.TurnModeSpin
 	}
 
-	if err == nil {
-		fmt.Println("Wheels: sent turn request id : ", id)
-		wh.turnReqQueue <- req
-	} else {
-		wh.respQueue <- req
-		err = fmt.Errorf("Error sending turn request to board id %s err - %s ", id, err)
+	req := WheelsReq{ID: id, ReqType: WheelsTurnReq, Result: 0, remaining: millis, unit: time.Millisecond}
+	req.send = func(amount int) error {
+		return wh.board.RoverTurn(side, dir, turnMode, 1, amount)
+	}
+	return wh.submit(req, MotionTurning, func(req WheelsReq) error {
+		if err := wh.sendChunk(wh.turnReqQueue, req); err != nil {
+			return fmt.Errorf("Error sending turn request to board id %s err - %s ", id, err)
+		}
+		wh.odometry.Move(wh.turnMotion(direction, dir, mode, millis))
+		fmt.Println("Wheels: sent turn request id : ", id, " mode : ", mode, " millis : ", millis)
+		return nil
+	})
+}
+
+// sendChunk sends the next part of a chunked motion. The request completes
+// when the board reports the last chunk done.
+func (wh *Wheels) sendChunk(queue *RequestQueue, req WheelsReq) error {
+	amount := req.remaining
+	if amount > MaxChunk {
+		amount = MaxChunk
+	}
+	req.remaining -= amount
+
+	queue.Push(req, time.Duration(amount)*req.unit)
+	if err := req.send(amount); err != nil {
+		queue.Remove(req)
+		wh.respond(req)
+		return err
 	}
+	return nil
+}
 
-	return
+// ApplyTrim sets the firmware default speed of each wheel to the trimmed
+// DefaultPWM, so that steps and turns are corrected too. It has to be
+// applied again after the board is reset.
+func (wh *Wheels) ApplyTrim() error {
+	left, right := wh.trim(DefaultPWM, DefaultPWM)
+	fmt.Println("Wheels: trimmed default speeds ", left, right)
+	return wh.board.RoverSetSpeed(left, right)
 }
 
-func (wh *Wheels) processTurnDone(data interface{}) {
-	req := <-wh.turnReqQueue
-	wh.respQueue <- req
+// trim scales the PWM duty of each wheel by its calibrated trim.
+func (wh *Wheels) trim(left int, right int) (int, int) {
+	scale := func(pwm int, trim float64) int {
+		pwm = int(float64(pwm)*trim + 0.5)
+		if pwm > MaxPWM {
+			pwm = MaxPWM
+		}
+		return pwm
+	}
+	return scale(left, wh.calibration.LeftTrim), scale(right, wh.calibration.RightTrim)
+}
+
+// RunDefault drives both wheels in direction at the default speed.
+func (wh *Wheels) RunDefault(direction string) error {
+	return wh.runPWM(direction, DefaultPWM, DefaultPWM)
 }
 
-func (wh *Wheels) Step(id string, direction string, steps int) (err error) {
+// Run drives both wheels in direction. Speeds are percentages, and 0 on
+// both wheels stops them.
+func (wh *Wheels) Run(direction string, leftSpeed int, rightSpeed int) error {
+	if leftSpeed == 0 && rightSpeed == 0 {
+		return wh.Stop()
+	}
+	return wh.runPWM(direction, speedToPWM(leftSpeed), speedToPWM(rightSpeed))
+}
 
-	req := WheelsReq{ID: id, ReqType: WheelsStepReq, Result: 0}
+func (wh *Wheels) runPWM(direction string, leftPWM int, rightPWM int) error {
+	if direction != "forward" {
+		leftPWM, rightPWM = -leftPWM, -rightPWM
+	}
+	return wh.startRun(leftPWM, rightPWM)
+}
 
-	if direction == "forward" {
-		err = wh.board.RoverStep(board.MoveDirFwd, steps)
-	} else {
-		err = wh.board.RoverStep(board.MoveDirRev, steps)
+// Drive runs each wheel at its own speed, given as a percentage from -100 to
+// 100 where negative values turn the wheel backward.
+func (wh *Wheels) Drive(leftSpeed int, rightSpeed int) error {
+	leftPWM, rightPWM := speedToPWM(abs(leftSpeed)), speedToPWM(abs(rightSpeed))
+	if leftSpeed < 0 {
+		leftPWM = -leftPWM
+	}
+	if rightSpeed < 0 {
+		rightPWM = -rightPWM
 	}
+	return wh.startRun(leftPWM, rightPWM)
+}
 
-	if err == nil {
-		fmt.Println("Wheels: sent step request id : ", id)
-		wh.stepReqQueue <- req
-	} else {
-		wh.respQueue <- req
-		err = fmt.Errorf("Error sending step request to board id %s err - %s ", id, err)
+// SetSpeedLimit scales the speed of Run and Drive down to limit, from 0 to
+// 1, including the one in progress. Steps and turns are timed by the
+// firmware and keep their speed, so that they still cover their distance or
+// angle.
+func (wh *Wheels) SetSpeedLimit(limit float64) error {
+	m := wh.motion
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if limit == m.limit {
+		return nil
 	}
+	fmt.Println("Wheels: speed limit ", limit)
+	m.limit = limit
+	if m.state != MotionRunning {
+		return nil
+	}
+	return wh.run(m.drive[0], m.drive[1])
+}
+
+// startRun submits an open ended motion at the given untrimmed PWM duties.
+func (wh *Wheels) startRun(leftPWM int, rightPWM int) error {
+	return wh.submit(WheelsReq{}, MotionRunning, func(req WheelsReq) error {
+		return wh.run(leftPWM, rightPWM)
+	})
+}
 
-	return
+// run drives the wheels at the given untrimmed PWM duties, negative for a
+// wheel turning backward, scaled by the speed limit. The wheels ramp up or
+// down to the new speeds at the calibrated acceleration. Must be called
+// with the motion mutex held.
+func (wh *Wheels) run(leftPWM int, rightPWM int) error {
+	m := wh.motion
+	limited := func(pwm int) int {
+		return int(float64(pwm) * m.limit)
+	}
+	m.drive = [2]int{leftPWM, rightPWM}
+	m.target = [2]int{limited(leftPWM), limited(rightPWM)}
+	return wh.startRamp()
+}
+
+// startRamp takes the first step towards the target speeds and leaves the
+// rest to the ramp monitor. Must be called with the motion mutex held.
+func (wh *Wheels) startRamp() error {
+	m := wh.motion
+	done, err := wh.rampStep()
+	if err != nil {
+		return err
+	}
+	if done {
+		m.ramp.Stop()
+	} else {
+		m.ramp.Start(RampInterval, wh.ramp)
+	}
+	return nil
 }
 
-func (wh *Wheels) WheelStep(id string, which string, direction string, steps int) (err error) {
+// ramp moves the wheels one step further towards the target speeds, and
+// finishes a stop once they are reached.
+func (wh *Wheels) ramp() {
+	m := wh.motion
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	req := WheelsReq{ID: id, ReqType: WheelsStepReq, Result: 0}
+	// a step or turn may have taken over the wheels while this step waited
+	if !m.ramp.Running() || (m.state != MotionRunning && m.state != MotionStopping) {
+		return
+	}
 
-	switch which {
-	case "right":
-		if direction == "forward" {
-			err = wh.board.RoverWheelStep(board.MoveStepRight, board.MoveDirFwd, steps)
-		} else {
-			err = wh.board.RoverWheelStep(board.MoveStepRight, board.MoveDirRev, steps)
+	done, err := wh.rampStep()
+	if err != nil {
+		fmt.Println("Wheels: could not change speed - err ", err)
+	}
+	if done || err != nil {
+		m.ramp.Stop()
+	}
+}
+
+// rampStep drives the wheels at speeds one acceleration step closer to the
+// target. Both wheels change by the same part of their way to the target,
+// so that they reach it together and the rover keeps its course. done is
+// true when the target is reached; a target of a stop then stops the
+// wheels. Must be called with the motion mutex held.
+func (wh *Wheels) rampStep() (done bool, err error) {
+	m := wh.motion
+	next := m.target
+	if step := wh.calibration.Acceleration / 100 * float64(MaxPWM) * RampInterval.Seconds(); step > 0 {
+		furthest := math.Max(math.Abs(float64(m.target[0]-m.current[0])), math.Abs(float64(m.target[1]-m.current[1])))
+		if furthest > step {
+			for i := range next {
+				next[i] = m.current[i] + int(float64(m.target[i]-m.current[i])*step/furthest)
+			}
 		}
-	case "left":
-		if direction == "forward" {
-			err = wh.board.RoverWheelStep(board.MoveStepLeft, board.MoveDirFwd, steps)
-		} else {
-			err = wh.board.RoverWheelStep(board.MoveStepLeft, board.MoveDirRev, steps)
+	}
+	done = next == m.target
+
+	if done && m.state == MotionStopping {
+		if err := wh.board.RoverStop(); err != nil {
+			return done, err
 		}
+		m.current, m.state = [2]int{}, MotionIdle
+		wh.odometry.Stop()
+		return done, nil
 	}
+	return done, wh.sendDrive(next)
+}
 
-	if err == nil {
-		fmt.Println("Wheels: sent step request id : ", id)
-		wh.stepReqQueue <- req
-	} else {
-		wh.respQueue <- req
-		err = fmt.Errorf("Error sending step request to board id %s err - %s ", id, err)
+// sendDrive gives the wheels the untrimmed PWM duties, negative for a wheel
+// turning backward. Must be called with the motion mutex held.
+func (wh *Wheels) sendDrive(pwm [2]int) error {
+	leftDir, rightDir := board.MoveDirFwd, board.MoveDirFwd
+	if pwm[0] < 0 {
+		leftDir = board.MoveDirRev
+	}
+	if pwm[1] < 0 {
+		rightDir = board.MoveDirRev
+	}
+	left, right := wh.trim(abs(pwm[0]), abs(pwm[1]))
+	if err := wh.board.RoverDrive(leftDir, left, rightDir, right); err != nil {
+		return err
 	}
 
-	return
+	wh.motion.current = pwm
+	wh.odometry.Move(wh.wheelMotion(pwm[0], pwm[1], 0))
+	return nil
 }
 
-func (wh *Wheels) processStepDone(data interface{}) {
-	req := <-wh.stepReqQueue
-	wh.respQueue <- req
+// Curve drives along an arc given a linear speed and an angular speed, both
+// as percentages. A positive angular speed curves to the right. When a wheel
+// would exceed full speed both are scaled down, keeping the arc's shape.
+func (wh *Wheels) Curve(linear int, angular int) error {
+	left, right := linear+angular, linear-angular
+	if fastest := maxAbs(left, right); fastest > 100 {
+		left, right = left*100/fastest, right*100/fastest
+	}
+	return wh.Drive(left, right)
 }
 
-func (wh *Wheels) Run(direction string, leftSpeed int, rightSpeed int) error {
-	if direction == "forward" {
-		return wh.board.RoverRun(board.MoveDirFwd, byte(leftSpeed), byte(rightSpeed))
-	} else {
-		return wh.board.RoverRun(board.MoveDirRev, byte(leftSpeed), byte(rightSpeed))
+// DriveVelocity drives at speed cm per second, negative when backing up,
+// while turning at turnRate degrees per second clockwise. When a wheel would
+// exceed full speed both are scaled down, keeping the arc's shape.
+func (wh *Wheels) DriveVelocity(speed float64, turnRate float64) error {
+	perPWM := wh.calibration.Speed() / float64(DefaultPWM)
+	// each wheel runs faster or slower than the middle of the rover by half
+	// the wheel base times the turn rate
+	half := turnRate * math.Pi / 180 * wh.calibration.WheelBase() / 2
+	left, right := (speed+half)/perPWM, (speed-half)/perPWM
+	if fastest := math.Max(math.Abs(left), math.Abs(right)); fastest > float64(MaxPWM) {
+		left, right = left*float64(MaxPWM)/fastest, right*float64(MaxPWM)/fastest
+	}
+	return wh.startRun(int(math.Round(left)), int(math.Round(right)))
+}
+
+// wheelMotion returns how the rover moves for d with its wheels at the given
+// untrimmed PWM duties, negative for a wheel turning backward. Wheel speed is
+// taken to be proportional to PWM, which the trim is there to make true.
+func (wh *Wheels) wheelMotion(left int, right int, d time.Duration) Motion {
+	perPWM := wh.calibration.Speed() / float64(DefaultPWM)
+	leftSpeed, rightSpeed := float64(left)*perPWM, float64(right)*perPWM
+	return Motion{
+		Speed:    (leftSpeed + rightSpeed) / 2,
+		TurnRate: (leftSpeed - rightSpeed) / wh.calibration.WheelBase() * 180 / math.Pi,
+		Duration: d,
+	}
+}
+
+// turnMotion returns how the rover moves in a turn of millis towards
+// direction in mode, backing up when dir is reverse. It uses the calibrated
+// turn rate rather than the wheel speeds, as turns are timed with it.
+func (wh *Wheels) turnMotion(direction string, dir byte, mode string, millis int) Motion {
+	rate := wh.calibration.TurnRate(direction, mode) * 1000
+	if direction == "left" {
+		rate = -rate
+	}
+	motion := Motion{TurnRate: rate, Duration: time.Duration(millis) * time.Millisecond}
+	if mode != TurnSpin {
+		// the middle of the rover moves at half the speed of the outer wheel
+		motion.Speed = math.Abs(rate) * math.Pi / 180 * wh.calibration.WheelBase() / 2
+	}
+	if dir == board.MoveDirRev {
+		// backing up around the wheel on the side of direction turns the
+		// rover the other way
+		motion.Speed, motion.TurnRate = -motion.Speed, -motion.TurnRate
+	}
+	return motion
+}
+
+func speedToPWM(speed int) int {
+	if speed < 0 {
+		speed = 0
+	} else if speed > 100 {
+		speed = 100
 	}
+	return speed * MaxPWM / 100
 }
 
+func maxAbs(a int, b int) int {
+	if a < 0 {
+		a = -a
+	}
+	if b < 0 {
+		b = -b
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Stop stops the wheels whatever they do. An open ended motion slows down
+// to the stop at the calibrated acceleration, a step or turn in progress
+// stops at once and is answered by the firmware. The motions waiting are
+// answered without running.
 func (wh *Wheels) Stop() error {
-	return wh.board.RoverStop()
+	m := wh.motion
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	wh.completePending()
+	running := m.state == MotionRunning || m.state == MotionStopping
+	wh.forget()
+	if !running || wh.calibration.Acceleration <= 0 {
+		return wh.stopNow()
+	}
+	m.state, m.target = MotionStopping, [2]int{}
+	return wh.startRamp()
+}
+
+// EmergencyStop stops the wheels at once, without slowing down, and
+// otherwise as Stop does.
+func (wh *Wheels) EmergencyStop() error {
+	m := wh.motion
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	wh.completePending()
+	wh.forget()
+	return wh.stopNow()
+}
+
+// StopRamp stops changing the wheel speeds, for when the board is gone.
+func (wh *Wheels) StopRamp() {
+	wh.motion.ramp.Stop()
+}
+
+// stopNow stops the wheels at once. Must be called with the motion mutex
+// held.
+func (wh *Wheels) stopNow() error {
+	wh.motion.ramp.Stop()
+	wh.motion.current = [2]int{}
+	if err := wh.board.RoverStop(); err != nil {
+		return err
+	}
+	wh.odometry.Stop()
+	return nil
+}
+
+// respond hands a finished request to the server. The motion mutex may be
+// held, and the server may be waiting for it, so a full response queue is
+// waited on in the background rather than by the caller.
+func (wh *Wheels) respond(req Work) {
+	select {
+	case wh.respQueue <- req:
+	default:
+		go func() { wh.respQueue <- req }()
+	}
+}
+
+// FlushRequests forgets about the motions in progress and waiting, and
+// returns them.
+func (wh *Wheels) FlushRequests() []Work {
+	m := wh.motion
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	flushed := append(wh.turnReqQueue.Flush(), wh.stepReqQueue.Flush()...)
+	return append(flushed, wh.forget()...)
+}
+
+// ExpireRequests drops the motions the board has not answered in time and
+// returns them. When the motion in progress is one of them, the next one
+// waiting starts.
+func (wh *Wheels) ExpireRequests(now time.Time) []Work {
+	m := wh.motion
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	expired := append(wh.turnReqQueue.Expire(now), wh.stepReqQueue.Expire(now)...)
+	for _, req := range expired {
+		if req.(WheelsReq).seq == m.seq {
+			wh.next()
+		}
+	}
+	return expired
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/sparkybots/sparky/server/board"
+	"reflect"
+	"testing"
+)
+
+// finishMotion answers every chunk the wheels send for a motion, as the
+// firmware would, and returns the commands of kind sent on the way.
+func finishMotion(t *testing.T, wh *Wheels, conn *fakeConn, sub byte, done func(interface{})) (commands [][]byte) {
+	for {
+		sent := conn.commands(board.RoverMove, sub)
+		if len(sent) == 0 {
+			t.Fatal("no command sent for the motion")
+		}
+		commands = append(commands, sent...)
+		done(nil)
+		if state, _ := wh.State(); state == MotionIdle {
+			return
+		}
+	}
+}
+
+func TestTurnAngle(t *testing.T) {
+	cal := DefaultCalibration()
+	cal.LeftDegreesPerMilli, cal.RightDegreesPerMilli = 0.04, 0.04
+	cal.LeftSpinDegreesPerMilli, cal.RightSpinDegreesPerMilli = 0.08, 0.08
+	respQ := make(chan Work, 10)
+	rover, conn := testRover(t, respQ, cal, NewOdometry(NewEventStream()))
+	wh := rover.wheels
+
+	tests := []struct {
+		direction string
+		mode      string
+		degrees   float64
+		side      byte
+		turnMode  byte
+		// chunks are the turn times sent to the firmware, in ms
+		chunks []int
+	}{
+		{"right", TurnPivot, 360, board.TurnRight, board.TurnModePivot, []int{9000}},
+		{"left", TurnPivot, 720, board.TurnLeft, board.TurnModePivot, []int{MaxChunk, 18000 - MaxChunk}},
+		{"right", TurnSpin, 360, board.TurnRight, board.TurnModeSpin, []int{4500}},
+		{"left", TurnSpin, 720, board.TurnLeft, board.TurnModeSpin, []int{9000}},
+		// a negative angle turns the other way
+		{"left", TurnSpin, -360, board.TurnRight, board.TurnModeSpin, []int{4500}},
+	}
+	for _, test := range tests {
+		if err := wh.TurnAngle("1", test.direction, test.mode, test.degrees); err != nil {
+			t.Fatal(err)
+		}
+		var chunks []int
+		for _, cmd := range finishMotion(t, wh, conn, board.MoveTurn, wh.processTurnDone) {
+			// side, direction, angle, steps low and high, mode
+			if cmd[0] != test.side || cmd[1] != board.MoveDirFwd || cmd[2] != 1 || cmd[5] != test.turnMode {
+				t.Errorf("%s %s %v: sent %v", test.direction, test.mode, test.degrees, cmd)
+			}
+			chunks = append(chunks, int(cmd[3])|int(cmd[4])<<7)
+		}
+		if !reflect.DeepEqual(chunks, test.chunks) {
+			t.Errorf("%s %s %v: sent turns of %v ms, want %v", test.direction, test.mode, test.degrees, chunks, test.chunks)
+		}
+		if resp := <-respQ; resp.GetID() != "1" || resp.GetType() != WheelsTurnReq {
+			t.Errorf("%s %s %v: answered %v", test.direction, test.mode, test.degrees, resp)
+		}
+	}
+}
+
+func TestStepChunks(t *testing.T) {
+	respQ := make(chan Work, 10)
+	rover, conn := testRover(t, respQ, DefaultCalibration(), NewOdometry(NewEventStream()))
+	wh := rover.wheels
+
+	tests := []struct {
+		name string
+		// step sends the motion, with an ID of 1
+		step func() error
+		// which wheel steps, and the step counts sent to the firmware,
+		// which times every step at StepTime
+		which  byte
+		dir    byte
+		chunks []int
+	}{
+		{"short", func() error { return wh.Step("1", "forward", 100) }, board.MoveStepBoth, board.MoveDirFwd, []int{100}},
+		// the first count whose duration in ms overflowed a 16 bit int
+		{"over 546 steps", func() error { return wh.Step("1", "backward", 547) }, board.MoveStepBoth, board.MoveDirRev, []int{547}},
+		{"one chunk", func() error { return wh.Step("1", "forward", MaxChunk) }, board.MoveStepBoth, board.MoveDirFwd, []int{MaxChunk}},
+		{"chunked", func() error { return wh.Step("1", "forward", 20000) }, board.MoveStepBoth, board.MoveDirFwd, []int{MaxChunk, 20000 - MaxChunk}},
+		{"chunked distance", func() error { return wh.DriveDistance("1", "forward", 48000) }, board.MoveStepBoth, board.MoveDirFwd, []int{MaxChunk, MaxChunk, 40000 - 2*MaxChunk}},
+		{"chunked wheel step", func() error { return wh.WheelStep("1", "left", "forward", 20000) }, board.MoveStepLeft, board.MoveDirFwd, []int{MaxChunk, 20000 - MaxChunk}},
+	}
+	for _, test := range tests {
+		if err := test.step(); err != nil {
+			t.Fatal(err)
+		}
+		var chunks []int
+		for _, cmd := range finishMotion(t, wh, conn, board.MoveStep, wh.processStepDone) {
+			// wheel, direction, steps low and high
+			if cmd[0] != test.which || cmd[1] != test.dir {
+				t.Errorf("%s: sent %v", test.name, cmd)
+			}
+			chunks = append(chunks, int(cmd[2])|int(cmd[3])<<7)
+		}
+		if !reflect.DeepEqual(chunks, test.chunks) {
+			t.Errorf("%s: sent steps of %v, want %v", test.name, chunks, test.chunks)
+		}
+		if resp := <-respQ; resp.GetID() != "1" || resp.GetType() != WheelsStepReq {
+			t.Errorf("%s: answered %v", test.name, resp)
+		}
+	}
+}